@@ -0,0 +1,131 @@
+// access control by client address
+package main
+
+import (
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+type cidrList []*net.IPNet
+
+// parse a list of CIDR or addresses split by space or ','
+func parseCIDRList(s string) (cidrList, error) {
+	var l cidrList
+	for _, v := range strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t'
+	}) {
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, makeErr("invalid address: %s", v)
+			}
+			if ip.To4() != nil {
+				v += "/32"
+			} else {
+				v += "/128"
+			}
+		}
+
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, err
+		}
+		l = append(l, n)
+	}
+	return l, nil
+}
+
+func (l cidrList) contains(ip net.IP) bool {
+	for _, n := range l {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+type zoneACL struct {
+	zone  string
+	allow cidrList
+}
+
+// ACL controls what a client can query. Empty list allows all.
+type ACL struct {
+	query     cidrList
+	recursion cidrList
+	// sorted by length of zone, the longest first
+	zones []*zoneACL
+}
+
+// NewACL parses acl options, zones is in format of zone=cidr cidr,
+// use ',' to split multiple zones.
+func NewACL(query, recursion, zones string) (*ACL, error) {
+	var err error
+	a := &ACL{}
+
+	if a.query, err = parseCIDRList(query); err != nil {
+		return nil, err
+	}
+	if a.recursion, err = parseCIDRList(recursion); err != nil {
+		return nil, err
+	}
+
+	for _, v := range strings.Split(zones, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+
+		i := strings.Index(v, "=")
+		if i == -1 || !dns.IsFqdn(v[:i]) {
+			return nil, makeErr("invalid zone acl: %s", v)
+		}
+
+		z := &zoneACL{zone: strings.ToLower(v[:i])}
+		if z.allow, err = parseCIDRList(v[i+1:]); err != nil {
+			return nil, err
+		}
+		a.zones = append(a.zones, z)
+	}
+
+	sort.SliceStable(a.zones, func(i, j int) bool {
+		return dns.CountLabel(a.zones[i].zone) > dns.CountLabel(a.zones[j].zone)
+	})
+	return a, nil
+}
+
+func (a *ACL) AllowQuery(ip net.IP) bool {
+	return a.query == nil || a.query.contains(ip)
+}
+
+func (a *ACL) AllowRecursion(ip net.IP) bool {
+	return a.recursion == nil || a.recursion.contains(ip)
+}
+
+// AllowZone checks the acl of the closest zone containing qname.
+func (a *ACL) AllowZone(qname string, ip net.IP) bool {
+	for _, z := range a.zones {
+		if dns.IsSubDomain(z.zone, strings.ToLower(qname)) {
+			return z.allow.contains(ip)
+		}
+	}
+	return true
+}
+
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestACL(t *testing.T) {
+	a, err := NewACL("10.0.0.0/8, 192.168.1.1", "10.1.0.0/16",
+		"foo.com.=10.0.0.0/8, internal.foo.com.=10.2.0.0/16 10.3.0.0/16")
+	if err != nil {
+		t.Fatalf("cannot parse acl: %s", err)
+	}
+
+	cases := []struct {
+		ip                     string
+		qname                  string
+		query, recursion, zone bool
+	}{
+		{"10.1.1.1", "www.foo.com.", true, true, true},
+		{"10.2.1.1", "www.foo.com.", true, false, true},
+		{"10.1.1.1", "www.internal.foo.com.", true, true, false},
+		{"10.3.1.1", "internal.foo.com.", true, false, true},
+		{"192.168.1.1", "foo.com.", true, false, false},
+		{"192.168.1.2", "bar.com.", false, false, true},
+	}
+
+	for _, c := range cases {
+		ip := net.ParseIP(c.ip)
+		if a.AllowQuery(ip) != c.query {
+			t.Errorf("query from %s: %v", c.ip, !c.query)
+		}
+		if a.AllowRecursion(ip) != c.recursion {
+			t.Errorf("recursion from %s: %v", c.ip, !c.recursion)
+		}
+		if a.AllowZone(c.qname, ip) != c.zone {
+			t.Errorf("zone %s from %s: %v", c.qname, c.ip, !c.zone)
+		}
+	}
+
+	if _, err := NewACL("", "", "foo.com=10.0.0.0/8"); err == nil {
+		t.Errorf("zone should be fqdn")
+	}
+}
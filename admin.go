@@ -0,0 +1,228 @@
+// admin api served along with pprof
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+
+	"github.com/miekg/dns"
+	"go.papla.net/goutil/log"
+
+	"go.papla.net/yuanxiao/source"
+)
+
+func init() {
+	http.HandleFunc("/cache", adminCache)
+	http.HandleFunc("/cache/flush", adminCacheFlush)
+	http.HandleFunc("/explain", adminExplain)
+}
+
+// GET /cache: list all the entries.
+// GET /cache?name=foo.com.&type=A: look up one entry, class is IN if
+// not given.
+// All views are searched unless view=name is given.
+func adminCache(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		adminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	if GlobalContext == nil {
+		adminError(w, http.StatusServiceUnavailable, "server not initialized")
+		return
+	}
+
+	q := r.URL.Query()
+	views, ok := adminViews(w, q.Get("view"))
+	if !ok {
+		return
+	}
+
+	name := q.Get("name")
+	if name == "" {
+		rs := []*cacheRecord{}
+		for _, v := range views {
+			for _, e := range v.cache.Records() {
+				e.View = v.name
+				rs = append(rs, e)
+			}
+		}
+		adminReply(w, rs)
+		return
+	}
+
+	qtype, ok := dns.StringToType[q.Get("type")]
+	if !ok {
+		adminError(w, http.StatusBadRequest, "invalid type: "+q.Get("type"))
+		return
+	}
+
+	qclass := uint16(dns.ClassINET)
+	if v := q.Get("class"); v != "" {
+		if qclass, ok = dns.StringToClass[v]; !ok {
+			adminError(w, http.StatusBadRequest, "invalid class: "+v)
+			return
+		}
+	}
+
+	// the first found, default view is the last one to search
+	key := cacheKey(dns.Fqdn(name), qclass, qtype)
+	for _, v := range views {
+		if e := v.cache.Lookup(key); e != nil {
+			e.View = v.name
+			adminReply(w, e)
+			return
+		}
+	}
+	adminError(w, http.StatusNotFound, "not found")
+}
+
+// POST /cache/flush?name=foo.com.: flush all the entries of a name.
+// POST /cache/flush?suffix=com.: flush a name and its subdomains.
+// POST /cache/flush?all=true: flush everything.
+// Caches of all views are flushed unless view=name is given.
+func adminCacheFlush(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		adminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	if GlobalContext == nil {
+		adminError(w, http.StatusServiceUnavailable, "server not initialized")
+		return
+	}
+
+	q := r.URL.Query()
+	views, ok := adminViews(w, q.Get("view"))
+	if !ok {
+		return
+	}
+
+	var flush func(c *Cache) int
+	switch {
+	case q.Get("name") != "":
+		flush = func(c *Cache) int { return c.FlushName(q.Get("name")) }
+	case q.Get("suffix") != "":
+		flush = func(c *Cache) int { return c.FlushSuffix(q.Get("suffix")) }
+	case q.Get("all") == "true":
+		flush = func(c *Cache) int { return c.FlushAll() }
+	default:
+		adminError(w, http.StatusBadRequest, "one of name, suffix, all is required")
+		return
+	}
+
+	n := 0
+	for _, v := range views {
+		n += flush(v.cache)
+	}
+
+	log.Infof("%d cache entries flushed by %s", n, r.URL.RawQuery)
+	adminReply(w, map[string]int{"flushed": n})
+}
+
+type explainReply struct {
+	View   string   `json:"view"`
+	Client string   `json:"client"`
+	Steps  []string `json:"steps"`
+	Rcode  string   `json:"rcode"`
+	Source string   `json:"source,omitempty"`
+	Cached bool     `json:"cached"`
+	An     []string `json:"an,omitempty"`
+	Ns     []string `json:"ns,omitempty"`
+	Ex     []string `json:"ex,omitempty"`
+}
+
+// GET /explain?name=foo.com.&type=A&client=10.0.0.1: run a query as
+// if it comes from client, and return the steps to get the answer.
+// Optional ecs=10.0.0.0/24 sets the eDNS client subnet, and view=name
+// selects the view directly. Cache is read but never written.
+func adminExplain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		adminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	if GlobalContext == nil {
+		adminError(w, http.StatusServiceUnavailable, "server not initialized")
+		return
+	}
+
+	q := r.URL.Query()
+	question := dns.Question{
+		Name:   dns.Fqdn(q.Get("name")),
+		Qtype:  dns.TypeA,
+		Qclass: dns.ClassINET,
+	}
+	if q.Get("name") == "" {
+		adminError(w, http.StatusBadRequest, "name is required")
+		return
+	}
+	if v := q.Get("type"); v != "" {
+		t, ok := dns.StringToType[v]
+		if !ok {
+			adminError(w, http.StatusBadRequest, "invalid type: "+v)
+			return
+		}
+		question.Qtype = t
+	}
+
+	ip := net.ParseIP(q.Get("client"))
+	if ip == nil {
+		adminError(w, http.StatusBadRequest, "invalid client: "+q.Get("client"))
+		return
+	}
+
+	vr := &viewRequest{ip: ip, name: q.Get("view")}
+	client := hostSubnet(ip)
+	if v := q.Get("ecs"); v != "" {
+		_, ecs, err := net.ParseCIDR(v)
+		if err != nil {
+			adminError(w, http.StatusBadRequest, "invalid ecs: "+v)
+			return
+		}
+		vr.ecs = ecs
+		client = *ecs
+	}
+
+	t := &source.Trace{}
+	res := GlobalContext.process(vr, question, client, t)
+	adminReply(w, &explainReply{
+		View:   res.view.name,
+		Client: client.String(),
+		Steps:  t.Steps,
+		Rcode:  dns.RcodeToString[res.answer.Rcode],
+		Source: res.answer.Source,
+		Cached: res.cached,
+		An:     rrToString(res.answer.An),
+		Ns:     rrToString(res.answer.Ns),
+		Ex:     rrToString(res.answer.Ex),
+	})
+}
+
+// views selected by name, or all views if name is empty
+func adminViews(w http.ResponseWriter, name string) ([]*view, bool) {
+	if name == "" {
+		return GlobalContext.allViews(), true
+	}
+
+	v := GlobalContext.viewByName(name)
+	if v == nil {
+		adminError(w, http.StatusNotFound, "view not found: "+name)
+		return nil, false
+	}
+	return []*view{v}, true
+}
+
+func adminReply(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Warnf("cannot write admin reply: %s", err)
+	}
+}
+
+func adminError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
@@ -1,10 +1,16 @@
 package main
 
 import (
+	"bufio"
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
-	"github.com/golang/groupcache/lru"
 	"github.com/miekg/dns"
 
 	"go.papla.net/goutil/log"
@@ -12,69 +18,137 @@ import (
 	"go.papla.net/yuanxiao/source"
 )
 
+// number of shards used by NewCache, each shard has its own lock and
+// lru list.
+const cacheShards = 32
+
+// min entries of a shard for a size limited cache.
+const minShardSize = 64
+
 type Cache struct {
-	lru     *lru.Cache
+	shards  []*cacheShard
 	timeout time.Duration
+
+	// limits the lifetime of negative answers
+	ttls *ttlPolicies
+}
+
+type cacheShard struct {
+	// max entries in this shard, 0 for unlimit
+	size  int
+	ll    *list.List
+	items map[string]*list.Element
 	sync.Mutex
 }
 
 type cacheEntry struct {
-	ans *source.Answer
-	ts  time.Time
+	key    string
+	ans    *source.Answer
+	ts     time.Time
+	expire time.Time
+	// names the answer is built from, see answerNames
+	names []string
 }
 
 func NewCache(size int, to time.Duration) *Cache {
+	return newCache(size, to, cacheShards)
+}
+
+func newCache(size int, to time.Duration, shards int) *Cache {
 	switch size {
 	case 0:
 		return &Cache{}
 	case -1:
-		return &Cache{
-			lru:     lru.New(0),
-			timeout: to,
-		}
+		size = 0
 	default:
-		return &Cache{
-			lru:     lru.New(size),
-			timeout: to,
+		// keep shards large enough, or entries will be evicted far
+		// before the total size is reached
+		if size/shards < minShardSize {
+			shards = size / minShardSize
+			if shards == 0 {
+				shards = 1
+			}
+		}
+		// round up, so the total size is at least the given one
+		size = (size + shards - 1) / shards
+	}
+
+	c := &Cache{
+		shards:  make([]*cacheShard, shards),
+		timeout: to,
+	}
+	for i := range c.shards {
+		c.shards[i] = &cacheShard{
+			size:  size,
+			ll:    list.New(),
+			items: make(map[string]*list.Element),
 		}
 	}
+	return c
+}
+
+// fnv-1a, inlined to avoid allocation on every lookup.
+func (c *Cache) shard(key string) *cacheShard {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return c.shards[h%uint32(len(c.shards))]
 }
 
 func (c *Cache) Put(key string, a *source.Answer) {
-	if c.lru == nil {
+	if c.shards == nil {
 		return
 	}
 
-	c.Lock()
-	defer c.Unlock()
+	// ttl limits are applied on both Put and Get, records counted
+	// down on Get are kept above the min.
+	if c.ttls != nil {
+		a = c.ttls.apply(cacheKeyName(key), a)
+	}
 
 	e := &cacheEntry{}
+	e.key = key
 	e.ts = time.Now()
 	e.ans = a
+	e.names = answerNames(a)
+	e.expire = e.ts.Add(c.timeout)
+
+	// an entry is useless once any of its records expired, so
+	// calculate it here instead of on every Get.
+	if ttl, ok := minTTL(a); ok {
+		if exp := e.ts.Add(time.Duration(ttl) * time.Second); exp.Before(e.expire) {
+			e.expire = exp
+		}
+	}
 
-	c.lru.Add(key, e)
+	// negative answer may have no record to limit its lifetime
+	if c.ttls != nil && isNegative(a) {
+		if ttl := c.ttls.negative(cacheKeyName(key), a.Source); ttl != 0 {
+			if exp := e.ts.Add(time.Duration(ttl) * time.Second); exp.Before(e.expire) {
+				e.expire = exp
+			}
+		}
+	}
+
+	c.shard(key).add(e)
 }
 
 func (c *Cache) Get(key string) (*source.Answer, bool) {
-	if c.lru == nil {
+	if c.shards == nil {
 		return nil, false
 	}
 
-	c.Lock()
-	defer c.Unlock()
-	value, ok := c.lru.Get(key)
-	if !ok {
+	entry := c.shard(key).get(key, time.Now())
+	if entry == nil {
 		log.Debugf("cache miss for key: %s", key)
 		return nil, false
 	}
 
-	entry := value.(*cacheEntry)
-	elapse := time.Since(entry.ts)
-	if elapse > c.timeout {
-		return nil, false
-	}
-
-	delta := uint32(elapse.Seconds())
+	// copy records outside the lock
+	var ok bool
+	delta := uint32(time.Since(entry.ts).Seconds())
 	newans := &source.Answer{}
 
 	if newans.An, ok = checkTTL(entry.ans.An, delta); !ok {
@@ -88,9 +162,393 @@ func (c *Cache) Get(key string) (*source.Answer, bool) {
 	}
 	newans.Auth = entry.ans.Auth
 	newans.Rcode = entry.ans.Rcode
+	newans.RA = entry.ans.RA
+	newans.Source = entry.ans.Source
+	newans.Recursive = entry.ans.Recursive
+	if c.ttls != nil {
+		newans = c.ttls.apply(cacheKeyName(key), newans)
+	}
 	return newans, true
 }
 
+func (s *cacheShard) add(e *cacheEntry) {
+	s.Lock()
+	defer s.Unlock()
+
+	if el, ok := s.items[e.key]; ok {
+		el.Value = e
+		s.ll.MoveToFront(el)
+		return
+	}
+
+	s.items[e.key] = s.ll.PushFront(e)
+	if s.size != 0 && s.ll.Len() > s.size {
+		s.remove(s.ll.Back())
+	}
+}
+
+func (s *cacheShard) get(key string, now time.Time) *cacheEntry {
+	s.Lock()
+	defer s.Unlock()
+
+	el, ok := s.items[key]
+	if !ok {
+		return nil
+	}
+
+	e := el.Value.(*cacheEntry)
+	if !now.Before(e.expire) {
+		log.Debugf("cache entry expire: %s", key)
+		s.remove(el)
+		return nil
+	}
+
+	s.ll.MoveToFront(el)
+	return e
+}
+
+// caller should hold the lock
+func (s *cacheShard) remove(el *list.Element) {
+	s.ll.Remove(el)
+	delete(s.items, el.Value.(*cacheEntry).key)
+}
+
+// record of a cache entry in snapshot file, one per line in json.
+type cacheRecord struct {
+	Key    string    `json:"key"`
+	Time   time.Time `json:"time"`
+	Expire time.Time `json:"expire"`
+	Rcode  int       `json:"rcode"`
+	Auth   bool      `json:"auth,omitempty"`
+	RA     bool      `json:"ra,omitempty"`
+	Source string    `json:"source,omitempty"`
+	An     []string  `json:"an,omitempty"`
+	Ns     []string  `json:"ns,omitempty"`
+	Ex     []string  `json:"ex,omitempty"`
+
+	Recursive bool     `json:"recursive,omitempty"`
+	Depends   []string `json:"depends,omitempty"`
+
+	// set by admin api
+	View string `json:"view,omitempty"`
+}
+
+func newCacheRecord(e *cacheEntry) *cacheRecord {
+	return &cacheRecord{
+		Key:    e.key,
+		Time:   e.ts,
+		Expire: e.expire,
+		Rcode:  e.ans.Rcode,
+		Auth:   e.ans.Auth,
+		RA:     e.ans.RA,
+		Source: e.ans.Source,
+		An:     rrToString(e.ans.An),
+		Ns:     rrToString(e.ans.Ns),
+		Ex:     rrToString(e.ans.Ex),
+
+		Recursive: e.ans.Recursive,
+		Depends:   e.ans.Depends,
+	}
+}
+
+// Dump saves all the unexpired entries to a file, which can be read
+// by Load later.
+func (c *Cache) Dump(path string) error {
+	if c.shards == nil {
+		return nil
+	}
+
+	// a unique temp file, in case of other writers
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp)
+
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	now := time.Now()
+	count := 0
+	for _, s := range c.shards {
+		// oldest first, so the lru order is kept after loading
+		for _, e := range s.entries() {
+			if !now.Before(e.expire) {
+				continue
+			}
+
+			r := newCacheRecord(e)
+			if err := enc.Encode(r); err != nil {
+				f.Close()
+				return err
+			}
+			count++
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	log.Infof("%d cache entries saved to %s", count, path)
+	return os.Rename(tmp, path)
+}
+
+// Load fills the cache with entries from a file written by Dump,
+// expired entries are discarded. A missing file is not an error.
+func (c *Cache) Load(path string) error {
+	if c.shards == nil {
+		return nil
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	now := time.Now()
+	count := 0
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for dec.More() {
+		r := &cacheRecord{}
+		if err := dec.Decode(r); err != nil {
+			return err
+		}
+
+		// the timeout may be changed since last dump
+		expire := r.Expire
+		if limit := r.Time.Add(c.timeout); limit.Before(expire) {
+			expire = limit
+		}
+		if !now.Before(expire) {
+			continue
+		}
+
+		a := &source.Answer{
+			Rcode:     r.Rcode,
+			Auth:      r.Auth,
+			RA:        r.RA,
+			Source:    r.Source,
+			Recursive: r.Recursive,
+			Depends:   r.Depends,
+		}
+		if a.An, err = rrFromString(r.An); err != nil {
+			return err
+		}
+		if a.Ns, err = rrFromString(r.Ns); err != nil {
+			return err
+		}
+		if a.Ex, err = rrFromString(r.Ex); err != nil {
+			return err
+		}
+
+		c.shard(r.Key).add(&cacheEntry{
+			key:    r.Key,
+			ans:    a,
+			ts:     r.Time,
+			expire: expire,
+			names:  answerNames(a),
+		})
+		count++
+	}
+
+	log.Infof("%d cache entries loaded from %s", count, path)
+	return nil
+}
+
+// Records returns all the unexpired entries.
+func (c *Cache) Records() []*cacheRecord {
+	rs := []*cacheRecord{}
+	now := time.Now()
+	for _, s := range c.shards {
+		for _, e := range s.entries() {
+			if now.Before(e.expire) {
+				rs = append(rs, newCacheRecord(e))
+			}
+		}
+	}
+	return rs
+}
+
+// Lookup returns the entry of a key without affecting its lru order.
+func (c *Cache) Lookup(key string) *cacheRecord {
+	if c.shards == nil {
+		return nil
+	}
+
+	s := c.shard(key)
+	s.Lock()
+	defer s.Unlock()
+
+	el, ok := s.items[key]
+	if !ok {
+		return nil
+	}
+
+	e := el.Value.(*cacheEntry)
+	if !time.Now().Before(e.expire) {
+		return nil
+	}
+	return newCacheRecord(e)
+}
+
+// Flush removes entries whose keys are accepted by match, and returns
+// the number of removed entries.
+func (c *Cache) Flush(match func(key string) bool) int {
+	return c.flush(func(e *cacheEntry) bool {
+		return match(e.key)
+	})
+}
+
+func (c *Cache) flush(match func(e *cacheEntry) bool) int {
+	count := 0
+	for _, s := range c.shards {
+		s.Lock()
+		for el := s.ll.Front(); el != nil; {
+			next := el.Next()
+			if match(el.Value.(*cacheEntry)) {
+				s.remove(el)
+				count++
+			}
+			el = next
+		}
+		s.Unlock()
+	}
+	return count
+}
+
+// FlushName removes all the entries of a domain name.
+func (c *Cache) FlushName(name string) int {
+	name = dns.Fqdn(name)
+	return c.Flush(func(key string) bool {
+		return strings.EqualFold(cacheKeyName(key), name)
+	})
+}
+
+// FlushSuffix removes all the entries of a domain name and its
+// subdomains, and the ones built from them, such as CNAME chains to
+// them.
+func (c *Cache) FlushSuffix(suffix string) int {
+	suffix = dns.Fqdn(suffix)
+	return c.flush(func(e *cacheEntry) bool {
+		if dns.IsSubDomain(suffix, cacheKeyName(e.key)) {
+			return true
+		}
+		for _, name := range e.names {
+			if dns.IsSubDomain(suffix, name) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// FlushAll removes all the entries.
+func (c *Cache) FlushAll() int {
+	return c.Flush(func(string) bool { return true })
+}
+
+// names an answer is built from, which are the owners and targets of
+// its records and the names it depends on. A change of any of them
+// may change the answer, such as a CNAME target followed by the
+// server, or an address of MX target in the additional section.
+func answerNames(a *source.Answer) []string {
+	seen := make(map[string]bool)
+	add := func(name string) {
+		seen[strings.ToLower(name)] = true
+	}
+
+	for _, sec := range [][]dns.RR{a.An, a.Ns, a.Ex} {
+		for _, rr := range sec {
+			add(rr.Header().Name)
+			switch v := rr.(type) {
+			case *dns.CNAME:
+				add(v.Target)
+			case *dns.NS:
+				add(v.Ns)
+			case *dns.MX:
+				add(v.Mx)
+			case *dns.SRV:
+				add(v.Target)
+			}
+		}
+	}
+	for _, name := range a.Depends {
+		add(name)
+	}
+
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	return names
+}
+
+func cacheKey(name string, qclass, qtype uint16) string {
+	return fmt.Sprintf("%s %s %s", name, dns.ClassToString[qclass], dns.TypeToString[qtype])
+}
+
+func cacheKeyName(key string) string {
+	if i := strings.IndexByte(key, ' '); i != -1 {
+		return key[:i]
+	}
+	return key
+}
+
+// return all the entries from the oldest to the newest.
+func (s *cacheShard) entries() []*cacheEntry {
+	s.Lock()
+	defer s.Unlock()
+
+	es := make([]*cacheEntry, 0, s.ll.Len())
+	for el := s.ll.Back(); el != nil; el = el.Prev() {
+		es = append(es, el.Value.(*cacheEntry))
+	}
+	return es
+}
+
+func rrToString(sec []dns.RR) []string {
+	var r []string
+	for _, rr := range sec {
+		r = append(r, rr.String())
+	}
+	return r
+}
+
+func rrFromString(r []string) ([]dns.RR, error) {
+	var sec []dns.RR
+	for _, s := range r {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			return nil, err
+		}
+		sec = append(sec, rr)
+	}
+	return sec, nil
+}
+
+func minTTL(a *source.Answer) (uint32, bool) {
+	var min uint32
+	found := false
+	for _, sec := range [][]dns.RR{a.An, a.Ns, a.Ex} {
+		for _, rr := range sec {
+			if ttl := rr.Header().Ttl; !found || ttl < min {
+				min = ttl
+				found = true
+			}
+		}
+	}
+	return min, found
+}
+
 func checkTTL(sec []dns.RR, elapse uint32) ([]dns.RR, bool) {
 	var newsec []dns.RR
 	for _, rr := range sec {
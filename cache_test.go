@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"go.papla.net/yuanxiao/source"
+)
+
+func newAnswer(s string) *source.Answer {
+	rr, _ := dns.NewRR(s)
+	return &source.Answer{An: []dns.RR{rr}}
+}
+
+func TestCacheSize(t *testing.T) {
+	c := NewCache(0, time.Minute)
+	c.Put("foo.com.", newAnswer("foo.com. 60 A 1.1.1.1"))
+	if _, ok := c.Get("foo.com."); ok {
+		t.Errorf("disabled cache should not store entry")
+	}
+
+	c = NewCache(4, time.Minute)
+	for i := 0; i < 64; i++ {
+		key := fmt.Sprintf("%d.foo.com.", i)
+		c.Put(key, newAnswer(key+" 60 A 1.1.1.1"))
+	}
+
+	n := 0
+	for _, s := range c.shards {
+		n += s.ll.Len()
+	}
+	if n > 4 {
+		t.Errorf("cache size exceeded: %d > 4", n)
+	}
+
+	// a small cache is not split into shards too small to hold keys
+	// hashed to the same one
+	c = NewCache(64, time.Minute)
+	for i := 0; i < 64; i++ {
+		key := fmt.Sprintf("%d.foo.com.", i)
+		c.Put(key, newAnswer(key+" 60 A 1.1.1.1"))
+	}
+	for i := 0; i < 64; i++ {
+		if _, ok := c.Get(fmt.Sprintf("%d.foo.com.", i)); !ok {
+			t.Errorf("entry evicted before the cache is full: %d", i)
+		}
+	}
+}
+
+func TestCacheExpire(t *testing.T) {
+	c := NewCache(16, time.Minute)
+	c.Put("foo.com.", newAnswer("foo.com. 60 A 1.1.1.1"))
+	a, ok := c.Get("foo.com.")
+	if !ok || a.An[0].String() != normalize("foo.com. 60 A 1.1.1.1") {
+		t.Errorf("unexpected answer from cache: %v", a)
+	}
+
+	// expired by record ttl
+	c.Put("bar.com.", newAnswer("bar.com. 0 A 1.1.1.1"))
+	if _, ok := c.Get("bar.com."); ok {
+		t.Errorf("entry should be expired by ttl")
+	}
+
+	// expired by cache timeout
+	c = NewCache(16, 0)
+	c.Put("foo.com.", newAnswer("foo.com. 60 A 1.1.1.1"))
+	if _, ok := c.Get("foo.com."); ok {
+		t.Errorf("entry should be expired by timeout")
+	}
+}
+
+func TestCacheSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.snapshot")
+
+	c := NewCache(16, time.Minute)
+	c.Put("foo.com.", newAnswer("foo.com. 60 A 1.1.1.1"))
+	c.Put("bar.com.", newAnswer("bar.com. 0 A 1.1.1.1"))
+	if err := c.Dump(path); err != nil {
+		t.Fatalf("cannot dump cache: %s", err)
+	}
+	if tmp, _ := filepath.Glob(path + ".*"); len(tmp) != 0 {
+		t.Errorf("temp files left: %v", tmp)
+	}
+
+	c = NewCache(16, time.Minute)
+	if err := c.Load(path); err != nil {
+		t.Fatalf("cannot load cache: %s", err)
+	}
+
+	if a, ok := c.Get("foo.com."); !ok || a.An[0].String() != normalize("foo.com. 60 A 1.1.1.1") {
+		t.Errorf("unexpected answer from snapshot: %v", a)
+	}
+	if _, ok := c.Get("bar.com."); ok {
+		t.Errorf("expired entry should not be loaded")
+	}
+}
+
+func TestCacheFlush(t *testing.T) {
+	c := NewCache(16, time.Minute)
+	for _, name := range []string{"foo.com.", "www.foo.com.", "bar.com."} {
+		c.Put(cacheKey(name, dns.ClassINET, dns.TypeA), newAnswer(name+" 60 A 1.1.1.1"))
+		c.Put(cacheKey(name, dns.ClassINET, dns.TypeAAAA), newAnswer(name+" 60 AAAA ::1"))
+	}
+
+	if n := c.FlushName("www.foo.com"); n != 2 {
+		t.Errorf("flush name: %d != 2", n)
+	}
+	if n := c.FlushSuffix("com."); n != 4 {
+		t.Errorf("flush suffix: %d != 4", n)
+	}
+	if n := len(c.Records()); n != 0 {
+		t.Errorf("entries left after flush: %d", n)
+	}
+
+	// answers built from a changed name
+	c.Put(cacheKey("www.foo.com.", dns.ClassINET, dns.TypeA), newAnswer("www.foo.com. 60 CNAME cdn.bar.net."))
+	c.Put(cacheKey("foo.com.", dns.ClassINET, dns.TypeMX), newAnswer("foo.com. 60 MX 10 mail.bar.net."))
+	alias := newAnswer("foo.com. 60 A 1.1.1.1")
+	alias.Depends = []string{"lb.bar.net."}
+	c.Put(cacheKey("foo.com.", dns.ClassINET, dns.TypeA), alias)
+
+	for _, name := range []string{"cdn.bar.net.", "mail.bar.net.", "lb.bar.net."} {
+		if n := c.FlushSuffix(name); n != 1 {
+			t.Errorf("flush answers built from %s: %d != 1", name, n)
+		}
+	}
+}
+
+func normalize(s string) string {
+	rr, _ := dns.NewRR(s)
+	return rr.String()
+}
+
+func benchmarkCache(b *testing.B, shards int) {
+	const keys = 4096
+	c := newCache(keys, time.Minute, shards)
+	names := make([]string, keys)
+	for i := range names {
+		names[i] = fmt.Sprintf("%d.foo.com. IN A", i)
+		c.Put(names[i], newAnswer(fmt.Sprintf("%d.foo.com. 60 A 1.1.1.1", i)))
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			// one write for every 16 reads
+			if i%16 == 0 {
+				c.Put(names[i%keys], newAnswer("foo.com. 60 A 1.1.1.1"))
+			} else {
+				c.Get(names[i%keys])
+			}
+			i++
+		}
+	})
+}
+
+func BenchmarkCacheParallel(b *testing.B) {
+	for _, n := range []int{1, cacheShards} {
+		b.Run(fmt.Sprintf("shards=%d", n), func(b *testing.B) {
+			benchmarkCache(b, n)
+		})
+	}
+}
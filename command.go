@@ -0,0 +1,288 @@
+// subcommands of yuanxiao
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"go.papla.net/yuanxiao/source"
+)
+
+var commands = map[string]func(args []string) int{}
+
+func registerCommand(name string, f func(args []string) int) {
+	commands[name] = f
+}
+
+// run the subcommand if the first argument is one of them
+func runCommand() {
+	if len(os.Args) < 2 {
+		return
+	}
+
+	f := commands[os.Args[1]]
+	if f == nil {
+		return
+	}
+
+	os.Exit(f(os.Args[2:]))
+}
+
+func init() {
+	registerCommand("cache", cmdCache)
+	registerCommand("explain", cmdExplain)
+	registerCommand("check", cmdCheck)
+	registerCommand("migrate", cmdMigrate)
+}
+
+func cmdCache(args []string) int {
+	fs := flag.NewFlagSet("cache", flag.ExitOnError)
+	addr := fs.String("addr", "localhost:6060", "Admin address of the server, as server.pprof.addr.")
+	view := fs.String("view", "", "View of the cache, default is all views.")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: yuanxiao cache [options] list\n")
+		fmt.Fprintf(os.Stderr, "       yuanxiao cache [options] get NAME TYPE\n")
+		fmt.Fprintf(os.Stderr, "       yuanxiao cache [options] flush name|suffix NAME\n")
+		fmt.Fprintf(os.Stderr, "       yuanxiao cache [options] flush all\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	args = fs.Args()
+
+	var (
+		method = "GET"
+		path   = "/cache"
+		q      = url.Values{}
+	)
+
+	switch {
+	case len(args) == 1 && args[0] == "list":
+	case len(args) == 3 && args[0] == "get":
+		q.Set("name", args[1])
+		q.Set("type", args[2])
+	case len(args) == 2 && args[0] == "flush" && args[1] == "all":
+		method = "POST"
+		path = "/cache/flush"
+		q.Set("all", "true")
+	case len(args) == 3 && args[0] == "flush" && (args[1] == "name" || args[1] == "suffix"):
+		method = "POST"
+		path = "/cache/flush"
+		q.Set(args[1], args[2])
+	default:
+		fs.Usage()
+		return 2
+	}
+
+	if *view != "" {
+		q.Set("view", *view)
+	}
+
+	u := url.URL{Scheme: "http", Host: *addr, Path: path, RawQuery: q.Encode()}
+	r, err := adminRequest(method, u.String())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+
+	if args[0] == "flush" {
+		var v map[string]int
+		if err := json.Unmarshal(r, &v); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid reply: %s\n", err)
+			return 1
+		}
+		fmt.Printf("%d entries flushed\n", v["flushed"])
+		return 0
+	}
+
+	var rs []*cacheRecord
+	if args[0] == "get" {
+		rs = []*cacheRecord{{}}
+		err = json.Unmarshal(r, rs[0])
+	} else {
+		err = json.Unmarshal(r, &rs)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid reply: %s\n", err)
+		return 1
+	}
+
+	for _, e := range rs {
+		fmt.Printf(";; [%s] %s, expire in %s\n", e.View, e.Key, time.Until(e.Expire).Truncate(time.Second))
+		for _, sec := range [][]string{e.An, e.Ns, e.Ex} {
+			for _, rr := range sec {
+				fmt.Printf("%s\n", rr)
+			}
+		}
+	}
+	return 0
+}
+
+func cmdExplain(args []string) int {
+	fs := flag.NewFlagSet("explain", flag.ExitOnError)
+	addr := fs.String("addr", "localhost:6060", "Admin address of the server, as server.pprof.addr.")
+	client := fs.String("client", "127.0.0.1", "Address of the client to query as.")
+	ecs := fs.String("ecs", "", "Subnet in eDNS client subnet option, in CIDR.")
+	view := fs.String("view", "", "Select view by name instead of matching the client.")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: yuanxiao explain [options] NAME [TYPE]\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	args = fs.Args()
+
+	if len(args) < 1 || len(args) > 2 {
+		fs.Usage()
+		return 2
+	}
+
+	q := url.Values{}
+	q.Set("name", args[0])
+	if len(args) == 2 {
+		q.Set("type", args[1])
+	}
+	q.Set("client", *client)
+	if *ecs != "" {
+		q.Set("ecs", *ecs)
+	}
+	if *view != "" {
+		q.Set("view", *view)
+	}
+
+	u := url.URL{Scheme: "http", Host: *addr, Path: "/explain", RawQuery: q.Encode()}
+	r, err := adminRequest("GET", u.String())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+
+	e := &explainReply{}
+	if err := json.Unmarshal(r, e); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid reply: %s\n", err)
+		return 1
+	}
+
+	fmt.Printf(";; client %s in view %s\n", e.Client, e.View)
+	for i, s := range e.Steps {
+		fmt.Printf(";; %d. %s\n", i+1, s)
+	}
+	fmt.Printf(";; %s from %s, cached: %v\n", e.Rcode, e.Source, e.Cached)
+	for _, sec := range [][]string{e.An, e.Ns, e.Ex} {
+		for _, rr := range sec {
+			fmt.Printf("%s\n", rr)
+		}
+	}
+	return 0
+}
+
+func cmdCheck(args []string) int {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: yuanxiao check PATH\n")
+		fmt.Fprintf(os.Stderr, "Check files of the plain source at PATH, as source.plain.path.\n")
+	}
+	fs.Parse(args)
+	args = fs.Args()
+
+	if len(args) != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	ps, err := source.CheckPlain(args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+
+	for _, p := range ps {
+		fmt.Printf("%s\n", p)
+	}
+	if len(ps) > 0 {
+		fmt.Printf("%d problems found\n", len(ps))
+		return 1
+	}
+	return 0
+}
+
+// flags of an etcd v3 cluster, returns options of the etcd source
+// from them after parsing. machines is the name of the flag of
+// endpoints.
+func etcdFlags(fs *flag.FlagSet, machines string) func() map[string]string {
+	flags := map[string]*string{
+		"machines": fs.String(machines, "", "Endpoints of the etcd v3 cluster, as source.etcd.machines."),
+		"prefix":   fs.String("prefix", "", "Prefix of keys, as source.etcd.prefix."),
+		"tls.cert": fs.String("cert", "", "Client certificate, as source.etcd.tls.cert."),
+		"tls.key":  fs.String("key", "", "Key of the client certificate, as source.etcd.tls.key."),
+		"tls.ca":   fs.String("ca", "", "CA bundle, as source.etcd.tls.ca."),
+		"username": fs.String("user", "", "User name, as source.etcd.username."),
+		"password": fs.String("password", "", "Password, as source.etcd.password."),
+	}
+	return func() map[string]string {
+		o := make(map[string]string)
+		for k, v := range flags {
+			o[k] = *v
+		}
+		return o
+	}
+}
+
+func cmdMigrate(args []string) int {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	options := etcdFlags(fs, "to")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: yuanxiao migrate [options] -to ENDPOINTS MACHINES\n")
+		fmt.Fprintf(os.Stderr, "Copy records of the etcd source in a v2 tree at MACHINES to v3.\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	args = fs.Args()
+
+	o := options()
+	if len(args) != 1 || o["machines"] == "" {
+		fs.Usage()
+		return 2
+	}
+
+	n, err := source.EtcdMigrate(strings.Split(args[0], ","), o)
+	fmt.Printf("%d keys copied\n", n)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+	return 0
+}
+
+// send a request to admin api, return the body if succeed
+func adminRequest(method, u string) ([]byte, error) {
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var v map[string]string
+		if json.Unmarshal(body, &v) == nil && v["error"] != "" {
+			return nil, makeErr("server error: %s", v["error"])
+		}
+		return nil, makeErr("server error: %s", resp.Status)
+	}
+	return body, nil
+}
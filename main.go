@@ -16,6 +16,7 @@ import (
 )
 
 func main() {
+	runCommand()
 	parseArgs()
 	go setupSignals()
 
@@ -49,11 +50,64 @@ func parseArgs() {
 
 	// server options
 	option.String("server.addr", ":53",
-		"Address to bind. Default is udp port 53 on all interfaces.")
+		"Address to bind, use ',' to split multiple values. Default is port 53 on all interfaces.")
+	option.String("server.net", "udp",
+		"Transports to serve on each address, udp or tcp, use ',' to split multiple values.")
 	option.Int("server.cache.size", 1024,
 		"Query cache size for server. 0 to disable cache, and -1 for unlimit size.")
 	option.Duration("server.cache.timeout", 1*time.Minute, "Cache entry timeout for server.")
-	option.String("server.pprof.addr", "", "http address for pprof, leave blank to disable.")
+	option.String("server.cache.snapshot", "",
+		"File to save cache entries on shutdown or reload, and to warm cache from on start. Leave blank to disable.")
+	option.Bool("server.minimal", false,
+		"Minimal responses, only add additional records required, as glue of referrals.")
+	option.Bool("server.cname.chase", false,
+		"Follow CNAME left by a source through all the sources, to answer the whole chain.")
+	option.Int("server.ttl.min", 0,
+		"Min ttl in seconds of answers, records with lower ttl are raised to it.")
+	option.Int("server.ttl.max", 0,
+		"Max ttl in seconds of answers, 0 for unlimit.")
+	option.Int("server.ttl.negative", 0,
+		"Max ttl in seconds of negative answers(NXDOMAIN and NODATA), 0 for unlimit.")
+	option.String("server.ttl.override", "",
+		"Ttl limits for a source or zone, in format of name=min:max:negative, use ',' to split multiple values. Name is a source name, or a zone ending with '.'. Empty fields inherit server values.")
+	option.String("server.querylog.path", "",
+		"File to write query log in json lines, leave blank to disable.")
+	option.Int("server.querylog.size", 100,
+		"Max size in MB of query log file before rotation, 0 to disable rotation.")
+	option.Int("server.querylog.keep", 5,
+		"Number of rotated query log files to keep.")
+	option.Int("server.querylog.sample", 1,
+		"Log one of every N queries to keep overhead bounded.")
+	option.String("server.view.path", "",
+		"File of views, which select their own sources and cache by client. Leave blank to use the server config only.")
+	option.String("server.tsig.keys", "",
+		"Tsig keys to verify queries, in format of name:secret, use ',' to split multiple values.")
+	option.String("server.acl.query", "",
+		"Clients allowed to query, in CIDR or address, use ',' to split multiple values. Leave blank to allow all.")
+	option.String("server.acl.recursion", "",
+		"Clients allowed to query recursive sources such as relay, in CIDR or address, use ',' to split multiple values. Leave blank to allow all.")
+	option.String("server.acl.zone", "",
+		"Clients allowed to query a zone, in format of zone=cidr cidr, use ',' to split multiple zones.")
+	option.String("server.dnstap.output", "",
+		"dnstap output, unix:/path/to/socket or file:/path/to/file, leave blank to disable.")
+	option.String("server.dnstap.identity", "",
+		"Identity in dnstap messages. Default is the hostname.")
+	option.Int("server.rrl.rate", 0,
+		"Max responses per second to a client prefix over udp, 0 to disable response rate limiting.")
+	option.Int("server.rrl.nxdomain.rate", 0,
+		"Max NXDOMAIN responses per second to a client prefix. Default is the same as server.rrl.rate.")
+	option.Int("server.rrl.error.rate", 0,
+		"Max error responses per second to a client prefix. Default is the same as server.rrl.rate.")
+	option.Duration("server.rrl.window", 15*time.Second,
+		"Time window to account responses, a client keeps being limited in it after exceeding the rate.")
+	option.Int("server.rrl.slip", 2,
+		"Send one of every N limited responses truncated, for real clients to retry over tcp. 0 to drop all.")
+	option.Int("server.rrl.ipv4.prefix", 24,
+		"Prefix length to group ipv4 clients.")
+	option.Int("server.rrl.ipv6.prefix", 56,
+		"Prefix length to group ipv6 clients.")
+	option.String("server.pprof.addr", "",
+		"http address for pprof, metrics and admin api, leave blank to disable.")
 
 	// log options
 	option.String("log.level", "info",
@@ -67,6 +121,8 @@ func parseArgs() {
 
 	option.String("source.plain.path", "",
 		"Path to the root of zone file or directory.")
+	option.String("source.plain.geo.path", "",
+		"MaxMind database files to select records by location of clients, use ',' to split multiple values.")
 	option.String("source.relay.upstream", "",
 		"Upstream servers for dns relay, use ',' to split multiple values.")
 	option.String("source.relay.timeout", "2s",
@@ -74,11 +130,31 @@ func parseArgs() {
 	option.String("source.relay.delay", "0",
 		"Query delay. Make sure you know what it is before set it to a non-zero value.")
 	option.String("source.etcd.machines", "",
-		"List of etcd hosts.")
+		"List of etcd v3 endpoints, use ',' to split multiple values.")
+	option.String("source.etcd.prefix", "",
+		"Prefix of keys in etcd, such as /dns.")
+	option.String("source.etcd.timeout", "2s",
+		"Timeout of requests to etcd.")
+	option.String("source.etcd.tls.cert", "",
+		"Client certificate to connect etcd with TLS.")
+	option.String("source.etcd.tls.key", "",
+		"Key of the client certificate.")
+	option.String("source.etcd.tls.ca", "",
+		"CA bundle to verify etcd servers.")
+	option.String("source.etcd.username", "",
+		"User name of etcd authentication.")
+	option.String("source.etcd.password", "",
+		"Password of etcd authentication.")
 	option.String("source.etcd.cache.size", "64",
 		"Cache size for item get from etcd.")
 	option.String("source.etcd.cache.ttl", "60s",
-		"How long will a item be valid after get from etcd.")
+		"How long will a item be valid after get from etcd, changes are watched to drop items earlier.")
+	option.String("source.etcd.mirror", "false",
+		"Load all the keys under the prefix in memory and keep them in sync by watching.")
+	option.String("source.etcd.mirror.snapshot", "",
+		"File to save the keys mirrored, which are served if etcd is unreachable at start.")
+	option.String("source.etcd.geo.path", "",
+		"MaxMind database files to select records by location of clients, use ',' to split multiple values.")
 
 	// first, parse args to find the config path
 	if err := option.Parse(); err != nil {
@@ -93,8 +169,8 @@ func parseArgs() {
 
 	if option.GetBool("source.list") {
 		fmt.Printf("Support sources:\n")
-		for _, s := range source.Sources {
-			fmt.Printf("  %s\n", s)
+		for name := range source.Sources {
+			fmt.Printf("  %s\n", name)
 		}
 		os.Exit(0)
 	}
@@ -116,7 +192,7 @@ func parseArgs() {
 
 func setupSignals() {
 	sig := make(chan os.Signal, 5)
-	signal.Notify(sig, syscall.SIGHUP)
+	signal.Notify(sig, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
 
 	for s := range sig {
 		switch s {
@@ -125,6 +201,12 @@ func setupSignals() {
 			if err := serverReload(); err != nil {
 				log.Warnf("server reload failed: %s", err)
 			}
+		case syscall.SIGINT, syscall.SIGTERM:
+			log.Infof("server stopping")
+			if err := serverStop(); err != nil {
+				log.Warnf("server stop failed: %s", err)
+			}
+			os.Exit(0)
 		default:
 		}
 	}
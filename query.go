@@ -0,0 +1,172 @@
+// a simple client to test records
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func init() {
+	registerCommand("query", cmdQuery)
+}
+
+func cmdQuery(args []string) int {
+	fs := flag.NewFlagSet("query", flag.ExitOnError)
+	server := fs.String("server", "127.0.0.1:53", "Address of the server.")
+	ecs := fs.String("ecs", "", "Subnet in eDNS client subnet option, in CIDR.")
+	transport := fs.String("net", "udp", "Transport to use, udp or tcp.")
+	do := fs.Bool("do", false, "Set DNSSEC OK bit.")
+	count := fs.Int("count", 1, "Times to repeat the query.")
+	timeout := fs.Duration("timeout", 2*time.Second, "Timeout of each query.")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: yuanxiao query [options] NAME [TYPE]\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	args = fs.Args()
+
+	if len(args) < 1 || len(args) > 2 || *count < 1 {
+		fs.Usage()
+		return 2
+	}
+
+	qtype := dns.TypeA
+	if len(args) == 2 {
+		t, ok := dns.StringToType[strings.ToUpper(args[1])]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "invalid type: %s\n", args[1])
+			return 2
+		}
+		qtype = t
+	}
+
+	if *transport != "udp" && *transport != "tcp" {
+		fmt.Fprintf(os.Stderr, "invalid transport: %s\n", *transport)
+		return 2
+	}
+
+	addr := *server
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "53")
+	}
+
+	m := &dns.Msg{}
+	m.SetQuestion(dns.Fqdn(args[0]), qtype)
+	if *ecs != "" || *do {
+		m.SetEdns0(dns.DefaultMsgSize, *do)
+	}
+	if *ecs != "" {
+		o, err := newECS(*ecs)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			return 2
+		}
+		opt := m.IsEdns0()
+		opt.Option = append(opt.Option, o)
+	}
+
+	c := &dns.Client{
+		Net:     *transport,
+		Timeout: *timeout,
+	}
+
+	failed := false
+	for i := 0; i < *count; i++ {
+		m.Id = dns.Id()
+		r, rtt, err := c.Exchange(m, addr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, ";; query %d: %s\n", i+1, err)
+			failed = true
+			continue
+		}
+		printResponse(r, rtt, addr, *transport)
+	}
+
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+func newECS(s string) (*dns.EDNS0_SUBNET, error) {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, makeErr("invalid subnet: %s", s)
+	}
+
+	ones, _ := n.Mask.Size()
+	o := &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		SourceNetmask: uint8(ones),
+	}
+	if ip4 := n.IP.To4(); ip4 != nil {
+		o.Family = 1
+		o.Address = ip4
+	} else {
+		o.Family = 2
+		o.Address = n.IP
+	}
+	return o, nil
+}
+
+func printResponse(r *dns.Msg, rtt time.Duration, addr, transport string) {
+	var flags []string
+	for _, f := range []struct {
+		set  bool
+		name string
+	}{
+		{r.Response, "qr"},
+		{r.Authoritative, "aa"},
+		{r.Truncated, "tc"},
+		{r.RecursionDesired, "rd"},
+		{r.RecursionAvailable, "ra"},
+		{r.AuthenticatedData, "ad"},
+		{r.CheckingDisabled, "cd"},
+	} {
+		if f.set {
+			flags = append(flags, f.name)
+		}
+	}
+
+	fmt.Printf(";; %s, id: %d, flags: %s, from %s(%s) in %s\n",
+		dns.RcodeToString[r.Rcode], r.Id, strings.Join(flags, " "), addr, transport, rtt)
+
+	if o := r.IsEdns0(); o != nil {
+		for _, v := range o.Option {
+			if e, ok := v.(*dns.EDNS0_SUBNET); ok {
+				fmt.Printf(";; client subnet: %s/%d, scope: %d\n", e.Address, e.SourceNetmask, e.SourceScope)
+			}
+		}
+	}
+
+	for _, sec := range []struct {
+		name string
+		rr   []dns.RR
+	}{
+		{"ANSWER", r.Answer},
+		{"AUTHORITY", r.Ns},
+		{"ADDITIONAL", r.Extra},
+	} {
+		var rrs []dns.RR
+		for _, rr := range sec.rr {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				rrs = append(rrs, rr)
+			}
+		}
+		if len(rrs) == 0 {
+			continue
+		}
+
+		fmt.Printf(";; %s\n", sec.name)
+		for _, rr := range rrs {
+			fmt.Printf("%s\n", rr)
+		}
+	}
+	fmt.Printf("\n")
+}
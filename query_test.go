@@ -0,0 +1,27 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestNewECS(t *testing.T) {
+	o, err := newECS("10.1.2.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.Family != 1 || o.SourceNetmask != 24 || o.Address.String() != "10.1.2.0" {
+		t.Errorf("wrong subnet: %v", o)
+	}
+
+	o, err = newECS("2001:db8::/56")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.Family != 2 || o.SourceNetmask != 56 || o.Address.String() != "2001:db8::" {
+		t.Errorf("wrong subnet: %v", o)
+	}
+
+	if _, err = newECS("10.1.2.3"); err == nil {
+		t.Errorf("should fail without prefix length")
+	}
+}
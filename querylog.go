@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"go.papla.net/goutil/log"
+)
+
+// QueryLog writes query records as json lines to a file, which is
+// rotated by size. Records are written in background and dropped if
+// the writer can't catch up.
+type QueryLog struct {
+	// accessed atomically, keep them 64-bit aligned
+	counter uint64
+	dropped uint64
+
+	path   string
+	size   int64
+	keep   int
+	sample uint64
+
+	ch   chan *queryRecord
+	quit chan struct{}
+	done chan struct{}
+}
+
+type queryRecord struct {
+	Time    time.Time `json:"time"`
+	Client  string    `json:"client"`
+	Subnet  string    `json:"subnet,omitempty"`
+	Name    string    `json:"name"`
+	Type    string    `json:"type"`
+	Source  string    `json:"source,omitempty"`
+	Rcode   string    `json:"rcode"`
+	Cache   bool      `json:"cache"`
+	Latency int64     `json:"latency_us"`
+}
+
+// NewQueryLog opens the log file. size is the max bytes of a file
+// before rotation, 0 to disable rotation. keep is the number of
+// rotated files to keep. One of every sample queries is logged.
+func NewQueryLog(path string, size int64, keep int, sample int) (*QueryLog, error) {
+	if sample < 1 {
+		return nil, makeErr("invalid query log sample: %d", sample)
+	}
+
+	q := &QueryLog{
+		path:   path,
+		size:   size,
+		keep:   keep,
+		sample: uint64(sample),
+		ch:     make(chan *queryRecord, 4096),
+		quit:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	go q.run(f)
+	return q, nil
+}
+
+// Sampled tells whether the current query should be logged.
+func (q *QueryLog) Sampled() bool {
+	if q == nil {
+		return false
+	}
+	return atomic.AddUint64(&q.counter, 1)%q.sample == 0
+}
+
+func (q *QueryLog) Log(r *queryRecord) {
+	select {
+	case q.ch <- r:
+	default:
+		atomic.AddUint64(&q.dropped, 1)
+	}
+}
+
+// Close flushes pending records and closes the file. Records logged
+// after closing are dropped.
+func (q *QueryLog) Close() {
+	if q == nil {
+		return
+	}
+	close(q.quit)
+	<-q.done
+}
+
+func (q *QueryLog) run(f *os.File) {
+	defer close(q.done)
+
+	var written int64
+	if info, err := f.Stat(); err != nil {
+		log.Warnf("query log: %s", err)
+	} else {
+		written = info.Size()
+	}
+
+	w := bufio.NewWriter(f)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	// a failed rotation is retried on the next tick, records are kept
+	// writing to the current file until then.
+	retry := false
+
+	// write out buffered records. Errors are sticky in the writer, so
+	// it is reset to go on with the next records.
+	flush := func() {
+		if err := w.Flush(); err != nil {
+			log.Warnf("query log: %s", err)
+			w.Reset(f)
+		}
+	}
+
+	// write a record, and rotate the file if needed
+	write := func(r *queryRecord) {
+		b, err := json.Marshal(r)
+		if err != nil {
+			return
+		}
+		b = append(b, '\n')
+		w.Write(b)
+		written += int64(len(b))
+
+		if q.size == 0 || written < q.size || retry {
+			return
+		}
+
+		flush()
+		nf, err := q.rotate()
+		if err != nil {
+			log.Warnf("query log: %s", err)
+			retry = true
+			return
+		}
+		f.Close()
+		f = nf
+		w.Reset(f)
+		written = 0
+	}
+
+	for {
+		select {
+		case r := <-q.ch:
+			write(r)
+
+		case <-ticker.C:
+			flush()
+			retry = false
+			if n := atomic.SwapUint64(&q.dropped, 0); n != 0 {
+				log.Warnf("query log: %d records dropped", n)
+			}
+
+		case <-q.quit:
+			for {
+				select {
+				case r := <-q.ch:
+					write(r)
+				default:
+					flush()
+					f.Close()
+					return
+				}
+			}
+		}
+	}
+}
+
+// path.1 is the newest rotated file, and path.keep the oldest. path
+// is already moved if a rotation failed in opening the new file.
+func (q *QueryLog) rotate() (*os.File, error) {
+	if q.keep > 0 {
+		for i := q.keep - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", q.path, i), fmt.Sprintf("%s.%d", q.path, i+1))
+		}
+		if err := os.Rename(q.path, q.path+".1"); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	} else if err := os.Remove(q.path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	return os.OpenFile(q.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestQueryLogRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "query.log")
+	q, err := NewQueryLog(path, 512, 2, 2)
+	if err != nil {
+		t.Fatalf("cannot open query log: %s", err)
+	}
+
+	logged := 0
+	for i := 0; i < 100; i++ {
+		if !q.Sampled() {
+			continue
+		}
+		q.Log(&queryRecord{Time: time.Now(), Client: "127.0.0.1", Name: "foo.com.", Type: "A"})
+		logged++
+	}
+	q.Close()
+
+	if logged != 50 {
+		t.Errorf("sampled queries: %d != 50", logged)
+	}
+
+	if _, err := os.Stat(path + ".2"); err != nil {
+		t.Errorf("log not rotated: %s", err)
+	}
+	if _, err := os.Stat(path + ".3"); err == nil {
+		t.Errorf("too many rotated files kept")
+	}
+
+	f, err := os.Open(path + ".1")
+	if err != nil {
+		t.Fatalf("cannot open rotated log: %s", err)
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		r := &queryRecord{}
+		if err := json.Unmarshal(s.Bytes(), r); err != nil || r.Name != "foo.com." {
+			t.Errorf("invalid record: %s", s.Text())
+		}
+	}
+}
+
+func TestQueryLogRotateFailed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "query.log")
+	// path can't be moved onto a directory with files
+	if err := os.MkdirAll(filepath.Join(path+".1", "foo"), 0755); err != nil {
+		t.Fatalf("cannot make directory: %s", err)
+	}
+	q, err := NewQueryLog(path, 512, 1, 1)
+	if err != nil {
+		t.Fatalf("cannot open query log: %s", err)
+	}
+	for i := 0; i < 50; i++ {
+		q.Log(&queryRecord{Time: time.Now(), Client: "127.0.0.1", Name: "foo.com.", Type: "A"})
+	}
+	q.Close()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("cannot open log: %s", err)
+	}
+	defer f.Close()
+
+	n := 0
+	for s := bufio.NewScanner(f); s.Scan(); n++ {
+	}
+	if n != 50 {
+		t.Errorf("records written after a failed rotation: %d != 50", n)
+	}
+}
@@ -0,0 +1,107 @@
+// keep a record in etcd while a process runs
+package main
+
+import (
+	stdcontext "context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+
+	"go.papla.net/yuanxiao/source"
+)
+
+func init() {
+	registerCommand("register", cmdRegister)
+}
+
+func cmdRegister(args []string) int {
+	fs := flag.NewFlagSet("register", flag.ExitOnError)
+	options := etcdFlags(fs, "machines")
+	ttl := fs.Int64("ttl", 10, "Seconds of the lease, the record is removed if not renewed in time.")
+	subnet := fs.String("subnet", "", "Register for clients in the subnet, in CIDR.")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: yuanxiao register [options] NAME RECORD [COMMAND [ARG...]]\n")
+		fmt.Fprintf(os.Stderr, "Keep RECORD of NAME in etcd while COMMAND runs, or until interrupted.\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	args = fs.Args()
+
+	o := options()
+	if len(args) < 2 || o["machines"] == "" {
+		fs.Usage()
+		return 2
+	}
+
+	r := &source.Registration{Name: args[0], Record: args[1], TTL: *ttl}
+	if *subnet != "" {
+		ip, n, err := net.ParseCIDR(*subnet)
+		if err != nil || !ip.Equal(n.IP) {
+			fmt.Fprintf(os.Stderr, "invalid subnet: %s\n", *subnet)
+			return 2
+		}
+		r.Subnet = n
+	}
+
+	ctx, cancel := stdcontext.WithCancel(stdcontext.Background())
+	defer cancel()
+	removed, err := source.EtcdRegister(ctx, o, r)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+
+	code := 0
+	if len(args) > 2 {
+		code = runCommandWith(args[2:], sig)
+	} else {
+		<-sig
+	}
+
+	cancel()
+	<-removed
+	return code
+}
+
+// run a command until it exits, with signals passed to it, returns
+// its exit code.
+func runCommandWith(args []string, sig chan os.Signal) int {
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	for {
+		select {
+		case s := <-sig:
+			cmd.Process.Signal(s)
+		case err := <-exited:
+			var ee *exec.ExitError
+			if errors.As(err, &ee) {
+				return ee.ExitCode()
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err)
+				return 1
+			}
+			return 0
+		}
+	}
+}
@@ -0,0 +1,178 @@
+// response rate limiting, to mitigate reflection abuse
+package main
+
+import (
+	"expvar"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var rrlStats = expvar.NewMap("rrl")
+
+type rrlClass int
+
+const (
+	rrlAnswer rrlClass = iota
+	rrlNXDomain
+	rrlError
+	rrlClasses
+)
+
+type rrlAction int
+
+const (
+	rrlSend rrlAction = iota
+	rrlDrop
+	rrlSlip
+)
+
+// responses are accounted by client prefix and response class
+type rrlKey struct {
+	prefix [net.IPv6len]byte
+	class  rrlClass
+}
+
+type rrlBucket struct {
+	// credits of responses, negative when limited
+	balance int
+	last    time.Time
+	limited int
+}
+
+type RRL struct {
+	rates  [rrlClasses]int
+	window time.Duration
+	slip   int
+	v4mask net.IPMask
+	v6mask net.IPMask
+
+	buckets map[rrlKey]*rrlBucket
+	sweep   time.Time
+	sync.Mutex
+}
+
+// NewRRL returns nil if rate of answers is 0. Rates of other classes
+// are the same as answers if they are 0. Every slip limited response
+// is sent truncated for the client to retry over tcp, 0 to drop all.
+func NewRRL(rate, nxrate, errrate int, window time.Duration, slip, v4prefix, v6prefix int) (*RRL, error) {
+	if rate == 0 {
+		return nil, nil
+	}
+
+	if rate < 0 || nxrate < 0 || errrate < 0 || slip < 0 || window < time.Second {
+		return nil, makeErr("invalid rrl options")
+	}
+	if v4prefix < 0 || v4prefix > 32 || v6prefix < 0 || v6prefix > 128 {
+		return nil, makeErr("invalid rrl prefix: %d, %d", v4prefix, v6prefix)
+	}
+
+	if nxrate == 0 {
+		nxrate = rate
+	}
+	if errrate == 0 {
+		errrate = rate
+	}
+
+	return &RRL{
+		rates:   [rrlClasses]int{rate, nxrate, errrate},
+		window:  window,
+		slip:    slip,
+		v4mask:  net.CIDRMask(v4prefix, 32),
+		v6mask:  net.CIDRMask(v6prefix, 128),
+		buckets: make(map[rrlKey]*rrlBucket),
+		sweep:   time.Now(),
+	}, nil
+}
+
+// Check accounts a response to client, and tells what to do with it.
+// Only udp responses are limited.
+func (r *RRL) Check(client net.Addr, a *dns.Msg) rrlAction {
+	if r == nil {
+		return rrlSend
+	}
+
+	addr, ok := client.(*net.UDPAddr)
+	if !ok {
+		return rrlSend
+	}
+
+	key := rrlKey{class: rrlClassify(a)}
+	if ip := addr.IP.To4(); ip != nil {
+		copy(key.prefix[:], ip.Mask(r.v4mask))
+	} else {
+		copy(key.prefix[:], addr.IP.Mask(r.v6mask))
+	}
+
+	action := r.account(key, time.Now())
+	switch action {
+	case rrlSend:
+		rrlStats.Add("passed", 1)
+	case rrlDrop:
+		rrlStats.Add("dropped", 1)
+	case rrlSlip:
+		rrlStats.Add("slipped", 1)
+	}
+	return action
+}
+
+func (r *RRL) account(key rrlKey, now time.Time) rrlAction {
+	r.Lock()
+	defer r.Unlock()
+
+	// remove idle buckets once a window
+	if now.Sub(r.sweep) > r.window {
+		for k, b := range r.buckets {
+			if now.Sub(b.last) > r.window {
+				delete(r.buckets, k)
+			}
+		}
+		r.sweep = now
+	}
+
+	rate := r.rates[key.class]
+	b := r.buckets[key]
+	if b == nil {
+		b = &rrlBucket{balance: rate, last: now}
+		r.buckets[key] = b
+	}
+
+	// earn credits for the passed seconds, but no more than one
+	// second's worth. Debts are limited to one window.
+	if elapse := int(now.Sub(b.last) / time.Second); elapse > 0 {
+		b.balance += elapse * rate
+		if b.balance > rate {
+			b.balance = rate
+		}
+		b.last = b.last.Add(time.Duration(elapse) * time.Second)
+	}
+
+	b.balance--
+	if min := -rate * int(r.window/time.Second); b.balance < min {
+		b.balance = min
+	}
+
+	if b.balance >= 0 {
+		b.limited = 0
+		return rrlSend
+	}
+
+	b.limited++
+	if r.slip != 0 && b.limited%r.slip == 0 {
+		return rrlSlip
+	}
+	return rrlDrop
+}
+
+func rrlClassify(a *dns.Msg) rrlClass {
+	switch a.Rcode {
+	case dns.RcodeSuccess:
+		return rrlAnswer
+	case dns.RcodeNameError:
+		return rrlNXDomain
+	default:
+		return rrlError
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRRL(t *testing.T) {
+	r, err := NewRRL(2, 0, 0, 2*time.Second, 2, 24, 56)
+	if err != nil {
+		t.Fatalf("cannot create rrl: %s", err)
+	}
+
+	key := rrlKey{class: rrlAnswer}
+	now := time.Now()
+	expect := []rrlAction{rrlSend, rrlSend, rrlDrop, rrlSlip, rrlDrop, rrlSlip}
+	for i, e := range expect {
+		if a := r.account(key, now); a != e {
+			t.Errorf("action of response %d: %d != %d", i, a, e)
+		}
+	}
+
+	// other classes are accounted separately
+	if a := r.account(rrlKey{class: rrlNXDomain}, now); a != rrlSend {
+		t.Errorf("nxdomain should not be limited")
+	}
+
+	// debts should be paid before sending again
+	if a := r.account(key, now.Add(time.Second)); a == rrlSend {
+		t.Errorf("should still be limited after 1s")
+	}
+	if a := r.account(key, now.Add(3*time.Second)); a != rrlSend {
+		t.Errorf("should not be limited after window")
+	}
+}
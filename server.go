@@ -1,71 +1,169 @@
 package main
 
 import (
+	"crypto/sha512"
 	"errors"
 	"fmt"
 	"net"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/miekg/dns"
 	"go.papla.net/goutil/log"
 
 	"go.papla.net/yuanxiao/source"
+	"go.papla.net/yuanxiao/tap"
 
 	"go.papla.net/goutil/option"
 )
 
+// name of the view made from server config
+const defaultView = "default"
+
 type context struct {
-	sources []source.Source
-	cache   *Cache
-	server  *dns.Server
+	// views from view config, tried in order before the default one
+	views   []*view
+	def     *view
+	qlog    *QueryLog
+	rrl     *RRL
+	acl     *ACL
+	servers []*dns.Server
+	// only add additional records required
+	minimal bool
 }
 
 var GlobalContext *context
 
-func serverInit() error {
+func serverInit() (err error) {
 	var (
-		err     error
-		sources []source.Source
-		cache   *Cache
-		server  *dns.Server
+		views   []*view
+		def     *view
+		ttls    *ttlPolicies
+		qlog    *QueryLog
+		rrl     *RRL
+		acl     *ACL
+		servers []*dns.Server
 	)
 
-	enabled := option.GetString("source.enable")
-	ss := strings.Split(enabled, ",")
-	for _, s := range ss {
-		s = strings.TrimSpace(s)
-		obj := source.Sources[s]
-		if obj == nil {
-			return makeErr("invalid source: %s", s)
+	ttls, err = newTTLPolicies(option.GetInt("server.ttl.min"), option.GetInt("server.ttl.max"),
+		option.GetInt("server.ttl.negative"), option.GetString("server.ttl.override"))
+	if err != nil {
+		return err
+	}
+
+	def = &view{
+		name:     defaultView,
+		ttls:     ttls,
+		snapshot: option.GetString("server.cache.snapshot"),
+		chase:    option.GetBool("server.cname.chase"),
+	}
+	def.sources, def.names, err = loadSources(option.GetString("source.enable"), option.All())
+	if err != nil {
+		return err
+	}
+
+	// the sources are in use only if all the steps succeed
+	defer func() {
+		if err != nil {
+			closeSources(append(views, def))
 		}
+	}()
 
-		opt := getoption(s)
-		if err = obj.Reload(opt); err != nil {
-			log.Debugf("failed to config source: %s", s)
+	def.cache = NewCache(option.GetInt("server.cache.size"), option.GetDuration("server.cache.timeout"))
+	def.cache.ttls = ttls
+	if def.snapshot != "" {
+		if err = def.cache.Load(def.snapshot); err != nil {
+			log.Warnf("cannot load cache snapshot: %s", err)
+		}
+	}
+	def.watch()
+
+	if path := option.GetString("server.view.path"); path != "" {
+		defaults := make(map[string]string)
+		for k, v := range option.All() {
+			if strings.HasPrefix(k, "source.") {
+				defaults[k] = v
+			}
+		}
+		defaults["cache.size"] = strconv.Itoa(option.GetInt("server.cache.size"))
+		defaults["cache.timeout"] = option.GetDuration("server.cache.timeout").String()
+		defaults["cname.chase"] = strconv.FormatBool(option.GetBool("server.cname.chase"))
+
+		if views, err = loadViews(path, defaults, ttls); err != nil {
 			return err
 		}
+	}
 
-		sources = append(sources, obj)
-		log.Infof("source %s loaded", s)
+	rrl, err = NewRRL(option.GetInt("server.rrl.rate"), option.GetInt("server.rrl.nxdomain.rate"),
+		option.GetInt("server.rrl.error.rate"), option.GetDuration("server.rrl.window"),
+		option.GetInt("server.rrl.slip"), option.GetInt("server.rrl.ipv4.prefix"),
+		option.GetInt("server.rrl.ipv6.prefix"))
+	if err != nil {
+		return err
+	}
+
+	acl, err = NewACL(option.GetString("server.acl.query"), option.GetString("server.acl.recursion"),
+		option.GetString("server.acl.zone"))
+	if err != nil {
+		return err
+	}
+
+	tsig, err := parseTsigKeys(option.GetString("server.tsig.keys"))
+	if err != nil {
+		return err
 	}
 
-	cache = NewCache(option.GetInt("server.cache.size"), option.GetDuration("server.cache.timeout"))
+	var nets []string
+	for _, n := range strings.Split(option.GetString("server.net"), ",") {
+		n = strings.TrimSpace(n)
+		if n != "udp" && n != "tcp" {
+			return makeErr("option value error: server.net")
+		}
+		nets = append(nets, n)
+	}
 
-	server = &dns.Server{}
-	server.Addr = option.GetString("server.addr")
-	server.Net = "udp"
-	server.Handler = dns.HandlerFunc(rootHandler)
-	server.NotifyStartedFunc = func() {
-		log.Infof("server started")
+	for _, addr := range strings.Split(option.GetString("server.addr"), ",") {
+		for _, n := range nets {
+			server := &dns.Server{}
+			server.Addr = strings.TrimSpace(addr)
+			server.Net = n
+			server.Handler = dns.HandlerFunc(rootHandler)
+			server.TsigSecret = tsig
+			server.NotifyStartedFunc = func() {
+				log.Infof("server started on %s/%s", server.Addr, server.Net)
+			}
+			servers = append(servers, server)
+		}
+	}
+
+	// opened only after all the checks above, so a failed reload
+	// leaves nothing running
+	if path := option.GetString("server.querylog.path"); path != "" {
+		qlog, err = NewQueryLog(path, int64(option.GetInt("server.querylog.size"))<<20,
+			option.GetInt("server.querylog.keep"), option.GetInt("server.querylog.sample"))
+		if err != nil {
+			return err
+		}
+	}
+
+	if err = tap.Setup(option.GetString("server.dnstap.output"),
+		option.GetString("server.dnstap.identity")); err != nil {
+		qlog.Close()
+		return err
 	}
 
 	if GlobalContext == nil {
 		GlobalContext = &context{}
 	}
 
-	GlobalContext.sources = sources
-	GlobalContext.cache = cache
-	GlobalContext.server = server
+	GlobalContext.views = views
+	GlobalContext.def = def
+	GlobalContext.qlog = qlog
+	GlobalContext.rrl = rrl
+	GlobalContext.acl = acl
+	GlobalContext.servers = servers
+	GlobalContext.minimal = option.GetBool("server.minimal")
 
 	return nil
 }
@@ -81,26 +179,127 @@ func serverReload() error {
 		return err
 	}
 
-	oldserver := GlobalContext.server
+	// save the old cache for the new one to warm up
+	saveCache()
+
+	oldservers := GlobalContext.servers
+	oldqlog := GlobalContext.qlog
+	oldviews := GlobalContext.allViews()
 	if err := serverInit(); err != nil {
 		return err
 	}
 
-	return oldserver.Shutdown()
+	oldqlog.Close()
+	closeSources(oldviews)
+	return shutdown(oldservers)
+}
+
+func serverStop() error {
+	if GlobalContext == nil {
+		return nil
+	}
+
+	saveCache()
+	GlobalContext.qlog.Close()
+	tap.Close()
+	closeSources(GlobalContext.allViews())
+	return shutdown(GlobalContext.servers)
+}
+
+// release sources replaced by reloading
+func closeSources(views []*view) {
+	for _, v := range views {
+		for i, s := range v.sources {
+			if err := source.Close(s); err != nil {
+				log.Warnf("cannot close source %s of view %s: %s", v.names[i], v.name, err)
+			}
+		}
+	}
+}
+
+func shutdown(servers []*dns.Server) error {
+	var err error
+	for _, s := range servers {
+		if e := s.Shutdown(); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func saveCache() {
+	if GlobalContext == nil {
+		return
+	}
+
+	for _, v := range GlobalContext.allViews() {
+		if v.snapshot == "" {
+			continue
+		}
+		if err := v.cache.Dump(v.snapshot); err != nil {
+			log.Warnf("cannot save cache snapshot of view %s: %s", v.name, err)
+		}
+	}
 }
 
 func serverStart() error {
 	for {
-		s := GlobalContext.server
-		err := s.ListenAndServe()
-		if err != nil {
-			return err
+		// wait for all the servers, they are stopped by reload
+		servers := GlobalContext.servers
+		errs := make(chan error, len(servers))
+		for _, s := range servers {
+			go func(s *dns.Server) {
+				errs <- s.ListenAndServe()
+			}(s)
+		}
+
+		for range servers {
+			if err := <-errs; err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// make sources enabled in order, with their options in the form of
+// source.<name>.<key>.
+func loadSources(enabled string, all map[string]string) ([]source.Source, []string, error) {
+	var (
+		sources []source.Source
+		names   []string
+	)
+
+	// release the sources loaded before an error
+	fail := func(err error) ([]source.Source, []string, error) {
+		for _, obj := range sources {
+			source.Close(obj)
+		}
+		return nil, nil, err
+	}
+
+	ss := strings.Split(enabled, ",")
+	for _, s := range ss {
+		s = strings.TrimSpace(s)
+		obj := source.New(s)
+		if obj == nil {
+			return fail(makeErr("invalid source: %s", s))
+		}
+
+		opt := getoption(all, s)
+		if err := obj.Reload(opt); err != nil {
+			log.Debugf("failed to config source: %s", s)
+			return fail(err)
 		}
+
+		sources = append(sources, obj)
+		names = append(names, s)
+		log.Infof("source %s loaded", s)
 	}
+
+	return sources, names, nil
 }
 
-func getoption(name string) map[string]string {
-	all := option.All()
+func getoption(all map[string]string, name string) map[string]string {
 	o := make(map[string]string)
 	prefix := fmt.Sprintf("source.%s.", name)
 
@@ -115,99 +314,474 @@ func getoption(name string) map[string]string {
 	return o
 }
 
+// parse tsig keys in format of name:secret, use ',' to split multiple
+// values.
+func parseTsigKeys(s string) (map[string]string, error) {
+	keys := make(map[string]string)
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+
+		i := strings.Index(v, ":")
+		if i <= 0 {
+			return nil, makeErr("invalid tsig key: %s", v)
+		}
+		keys[dns.Fqdn(v[:i])] = v[i+1:]
+	}
+	return keys, nil
+}
+
+// default view is the last one
+func (c *context) allViews() []*view {
+	return append(c.views[:len(c.views):len(c.views)], c.def)
+}
+
+// select the first view matching the request
+func (c *context) view(r *viewRequest) *view {
+	if r.name != "" {
+		if v := c.viewByName(r.name); v != nil {
+			return v
+		}
+	}
+
+	for _, v := range c.views {
+		if v.match(r) {
+			return v
+		}
+	}
+	return c.def
+}
+
+// find view by name
+func (c *context) viewByName(name string) *view {
+	for _, v := range c.allViews() {
+		if v.name == name {
+			return v
+		}
+	}
+	return nil
+}
+
 func rootHandler(w dns.ResponseWriter, m *dns.Msg) {
 	// TODO: add some checks
 	if len(m.Question) != 1 {
 		// err
 	}
 
-	sources := GlobalContext.sources
-	cache := GlobalContext.cache
+	start := time.Now()
+	ctx := GlobalContext
+
+	tap.ClientQuery(w.RemoteAddr(), m, start)
 
 	q := m.Question[0]
 
 	a := &dns.Msg{}
 	a.SetReply(m)
 
-	// TODO: add ipv6 support
-	client := net.IPNet{
-		IP:   net.ParseIP(strings.Split(w.RemoteAddr().String(), ":")[0]),
-		Mask: net.CIDRMask(net.IPv4len*8, net.IPv4len*8),
-	}
-
-	//   or from eDNS
-	if o := m.IsEdns0(); o != nil {
-		for _, v := range o.Option {
-			if e, ok := v.(*dns.EDNS0_SUBNET); ok {
-				switch e.Family {
-				case 1: // IPv4
-					client = net.IPNet{
-						IP:   e.Address,
-						Mask: net.CIDRMask(int(e.SourceNetmask), net.IPv4len*8),
-					}
-				case 2: // IPv6
-				default:
-				}
-				break
-			}
+	ip := addrIP(w.RemoteAddr())
+	client, ecs := clientSubnet(ip, m)
+	log.Debugf("query from client: %s", client)
+
+	vr := &viewRequest{
+		ip:    ip,
+		ecs:   ecs,
+		local: w.LocalAddr(),
+	}
+	var tsig *dns.TSIG
+	if t := m.IsTsig(); t != nil && w.TsigStatus() == nil {
+		vr.tsig = t.Hdr.Name
+		tsig = t
+	}
+
+	res := ctx.process(vr, q, client, nil)
+	entry := res.answer
+	a.Answer = entry.An
+	a.Ns = entry.Ns
+	a.Extra = entry.Ex
+	a.Authoritative = entry.Auth
+	a.Rcode = entry.Rcode
+	a.RecursionAvailable = res.ra
+
+	if ctx.minimal && !isReferral(a) {
+		a.Extra = nil
+	}
+	if m.IsEdns0() != nil {
+		a.Extra = append(a.Extra[:len(a.Extra):len(a.Extra)], newOPT())
+	}
+	fitResponse(a, responseSize(w, m)-tsigSize(tsig))
+
+	switch ctx.rrl.Check(w.RemoteAddr(), a) {
+	case rrlDrop:
+		log.Debugf("response dropped by rrl: %s", w.RemoteAddr())
+		return
+	case rrlSlip:
+		a = &dns.Msg{}
+		a.SetReply(m)
+		a.Truncated = true
+	}
+
+	// the TSIG record must be the last one, it is signed by the
+	// server on writing.
+	if tsig != nil {
+		a.SetTsig(tsig.Hdr.Name, tsig.Algorithm, 300, time.Now().Unix())
+	}
+
+	w.WriteMsg(a)
+	tap.ClientResponse(w.RemoteAddr(), m, a, start, time.Now())
+
+	if ctx.qlog.Sampled() {
+		r := &queryRecord{
+			Time:    start,
+			Client:  ip.String(),
+			Name:    q.Name,
+			Type:    dns.TypeToString[q.Qtype],
+			Source:  entry.Source,
+			Rcode:   dns.RcodeToString[a.Rcode],
+			Cache:   res.cached,
+			Latency: int64(time.Since(start) / time.Microsecond),
 		}
+		if ecs != nil {
+			r.Subnet = ecs.String()
+		}
+		ctx.qlog.Log(r)
 	}
-	log.Debugf("query from client: %s", client)
+}
 
-	key := fmt.Sprintf("%s %s %s", q.Name, dns.ClassToString[q.Qclass], dns.TypeToString[q.Qtype])
-	if entry, ok := cache.Get(key); !ok {
-		var answer *source.Answer
-		delegation := false
-		recursion := false
-		for _, obj := range sources {
-			log.Debugf("try to get answer from: %s", obj)
-			answer = obj.Query(q.Name, q.Qtype, client)
+// OPT record in responses to eDNS queries
+func newOPT() *dns.OPT {
+	o := &dns.OPT{}
+	o.Hdr.Name = "."
+	o.Hdr.Rrtype = dns.TypeOPT
+	o.SetUDPSize(dns.DefaultMsgSize)
+	return o
+}
 
-			// if one of the sources is authoritative, also has this
-			// domain, the final answer should be authoritative.
-			if answer.Rcode == dns.RcodeSuccess && answer.Auth {
-				delegation = true
-			}
+// max size of the response to m
+func responseSize(w dns.ResponseWriter, m *dns.Msg) int {
+	if _, ok := w.RemoteAddr().(*net.TCPAddr); ok {
+		return dns.MaxMsgSize
+	}
 
-			// accept recursive query if one of the sources support
-			// this
-			if answer.RA {
-				recursion = true
-			}
+	if o := m.IsEdns0(); o != nil && o.UDPSize() > dns.MinMsgSize {
+		return int(o.UDPSize())
+	}
+	return dns.MinMsgSize
+}
 
-			if answer.An != nil || answer.Ns != nil || answer.Ex != nil {
-				break
-			}
+// room for the TSIG record signing a response to t, with the longest
+// MAC of hmac-sha512.
+func tsigSize(t *dns.TSIG) int {
+	if t == nil {
+		return 0
+	}
+
+	r := &dns.TSIG{
+		Hdr:       dns.RR_Header{Name: t.Hdr.Name, Rrtype: dns.TypeTSIG, Class: dns.ClassANY},
+		Algorithm: t.Algorithm,
+		MAC:       strings.Repeat("00", sha512.Size),
+	}
+	return dns.Len(r)
+}
+
+// a referral has no answer, but name servers in authority
+func isReferral(a *dns.Msg) bool {
+	if a.Authoritative || len(a.Answer) > 0 {
+		return false
+	}
+
+	for _, rr := range a.Ns {
+		if rr.Header().Rrtype == dns.TypeNS {
+			return true
 		}
+	}
+	return false
+}
 
-		a.Answer = answer.An
-		a.Ns = answer.Ns
-		a.Extra = answer.Ex
-		a.Authoritative = answer.Auth
-		a.Rcode = answer.Rcode
-		a.RecursionAvailable = recursion
+// drop records to fit the response in size. Additional records are
+// dropped first without truncation, except glue of referrals.
+func fitResponse(a *dns.Msg, size int) {
+	if a.Len() <= size {
+		return
+	}
+
+	if !isReferral(a) {
+		var ex []dns.RR
+		if o := a.IsEdns0(); o != nil {
+			ex = append(ex, o)
+		}
+		a.Extra = ex
+	}
+
+	a.Truncate(size)
+}
+
+// outcome of a query
+type queryResult struct {
+	view   *view
+	answer *source.Answer
+	cached bool
+	// recursion available
+	ra bool
+}
 
-		// postfix for flags
-		if delegation {
-			a.Authoritative = true
-			if a.Rcode == dns.RcodeNameError {
-				a.Rcode = dns.RcodeSuccess
+// process selects view for the query, checks acl, then resolves it.
+func (c *context) process(vr *viewRequest, q dns.Question, client net.IPNet, t *source.Trace) *queryResult {
+	res := &queryResult{}
+	res.view = c.view(vr)
+	log.Debugf("query in view: %s", res.view.name)
+	t.Addf("view: %s", res.view.name)
+
+	if !c.acl.AllowQuery(vr.ip) || !c.acl.AllowZone(q.Name, vr.ip) {
+		log.Debugf("query refused: %s from %s", q.Name, vr.ip)
+		t.Addf("refused by acl")
+		res.answer = &source.Answer{Rcode: dns.RcodeRefused}
+		return res
+	}
+
+	recursion := c.acl.AllowRecursion(vr.ip)
+	if !recursion {
+		t.Addf("recursion not allowed by acl")
+	}
+
+	res.answer, res.cached = res.view.resolve(q, client, recursion, t)
+	res.ra = res.answer.RA && recursion
+	return res
+}
+
+// client subnet from the address, or from eDNS if presents.
+func clientSubnet(ip net.IP, m *dns.Msg) (net.IPNet, *net.IPNet) {
+	client := hostSubnet(ip)
+
+	o := m.IsEdns0()
+	if o == nil {
+		return client, nil
+	}
+
+	for _, v := range o.Option {
+		if e, ok := v.(*dns.EDNS0_SUBNET); ok {
+			switch e.Family {
+			case 1: // IPv4
+				client = net.IPNet{
+					IP:   e.Address.To4(),
+					Mask: net.CIDRMask(int(e.SourceNetmask), net.IPv4len*8),
+				}
+				return client, &client
+			case 2: // IPv6
+				client = net.IPNet{
+					IP:   e.Address.To16(),
+					Mask: net.CIDRMask(int(e.SourceNetmask), net.IPv6len*8),
+				}
+				return client, &client
+			default:
 			}
+			break
 		}
+	}
+	return client, nil
+}
 
-		// put into cache
-		cache.Put(key, answer)
-		log.Debugf("add to cache: %s", key)
+func hostSubnet(ip net.IP) net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return net.IPNet{
+			IP:   ip4,
+			Mask: net.CIDRMask(net.IPv4len*8, net.IPv4len*8),
+		}
+	}
+	return net.IPNet{
+		IP:   ip,
+		Mask: net.CIDRMask(net.IPv6len*8, net.IPv6len*8),
+	}
+}
+
+// resolve gets answer from cache, or from sources one after another.
+// Recursive sources are skipped if recursion is not allowed, and
+// their answers in cache are ignored. Nothing is put into cache while
+// tracing.
+func (v *view) resolve(q dns.Question, client net.IPNet, recursion bool, t *source.Trace) (*source.Answer, bool) {
+	key := cacheKey(q.Name, q.Qclass, q.Qtype)
+	if entry, ok := v.cache.Get(key); ok {
+		if recursion || !entry.Recursive && !v.recursive(entry.Source) {
+			log.Debugf("get from cache: %s", key)
+			t.Addf("cache hit: %s, answered by %s", key, entry.Source)
+			return entry, true
+		}
+		t.Addf("cache hit ignored: %s, answered by %s with a recursive source", key, entry.Source)
 	} else {
-		log.Debugf("get from cache: %s", key)
-		a.Answer = entry.An
-		a.Ns = entry.Ns
-		a.Extra = entry.Ex
-		a.Authoritative = entry.Auth
-		a.Rcode = entry.Rcode
+		t.Addf("cache miss: %s", key)
 	}
 
-	w.WriteMsg(a)
+	answer, skipped := v.lookup(q, client, recursion, t, 0)
+	if answer == nil {
+		t.Addf("no source available")
+		return &source.Answer{Rcode: dns.RcodeRefused}, false
+	}
+
+	if v.chase {
+		skipped = v.chaseCNAME(q, answer, client, recursion, t) || skipped
+	}
+
+	answer = v.ttls.apply(q.Name, answer)
+
+	// answer without recursive sources may differ from the full one
+	if !skipped && t == nil && !answer.NoCache {
+		v.cache.Put(key, answer)
+		log.Debugf("add to cache: %s", key)
+	}
+	return answer, false
+}
+
+// query the sources in order from the one at index from, until one
+// has the answer, nil if no source available. Whether any recursive
+// source is skipped is also returned.
+func (v *view) lookup(q dns.Question, client net.IPNet, recursion bool, t *source.Trace, from int) (*source.Answer, bool) {
+	var answer *source.Answer
+	delegation := false
+	ra := false
+	skipped := false
+	last := from
+	for i := from; i < len(v.sources); i++ {
+		obj := v.sources[i]
+		last = i
+		if !recursion && source.IsRecursive(obj) {
+			t.Addf("source %s: skipped, recursive", v.names[i])
+			skipped = true
+			continue
+		}
+
+		log.Debugf("try to get answer from: %s", obj)
+		t.Addf("source %s: query", v.names[i])
+		answer = source.Explain(obj, q.Name, q.Qtype, client, t)
+		answer.Source = v.names[i]
+		t.Addf("source %s: %s, %d answer, %d authority, %d additional",
+			v.names[i], dns.RcodeToString[answer.Rcode], len(answer.An), len(answer.Ns), len(answer.Ex))
+
+		// if one of the sources is authoritative, also has this
+		// domain, the final answer should be authoritative.
+		if answer.Rcode == dns.RcodeSuccess && answer.Auth {
+			delegation = true
+		}
+
+		// accept recursive query if one of the sources support
+		// this
+		if answer.RA {
+			ra = true
+		}
+
+		if answer.An != nil || answer.Ns != nil || answer.Ex != nil {
+			break
+		}
+	}
+
+	if answer == nil {
+		return nil, skipped
+	}
+
+	answer.RA = ra
+
+	// postfix for flags
+	if delegation {
+		answer.Auth = true
+		if answer.Rcode == dns.RcodeNameError {
+			answer.Rcode = dns.RcodeSuccess
+		}
+	}
+
+	if answer.Alias != "" {
+		v.flattenAlias(q, answer, client, t, last+1)
+	}
+	return answer, skipped
+}
+
+// answer addresses of the ALIAS target resolved by the sources after
+// the one giving the ALIAS, under the name queried.
+func (v *view) flattenAlias(q dns.Question, answer *source.Answer, client net.IPNet, t *source.Trace, from int) {
+	target := answer.Alias
+	answer.Alias = ""
+
+	// ALIAS is authoritative data, so recursion is always allowed
+	t.Addf("resolve ALIAS target %s", target)
+	sub, _ := v.lookup(dns.Question{Name: target, Qtype: q.Qtype, Qclass: q.Qclass}, client, true, t, from)
+	if sub == nil || (sub.Rcode != dns.RcodeSuccess && sub.Rcode != dns.RcodeNameError) {
+		t.Addf("ALIAS target %s not resolved", target)
+		answer.Rcode = dns.RcodeServerFailure
+		return
+	}
+
+	var an []dns.RR
+	for _, rr := range sub.An {
+		if rr.Header().Rrtype != q.Qtype {
+			continue
+		}
+		rr = dns.Copy(rr)
+		rr.Header().Name = q.Name
+		an = append(an, rr)
+	}
+
+	if an != nil {
+		answer.An = an
+		answer.Ns = nil
+	}
+	answer.NoCache = answer.NoCache || sub.NoCache
+	// the records of target are renamed, keep the names to flush the
+	// answer on changes of them
+	answer.Depends = append(answer.Depends, target)
+	answer.Depends = append(answer.Depends, answerNames(sub)...)
+}
+
+// follow the CNAME chain left by a source through all the sources,
+// returns whether any recursive source is skipped.
+func (v *view) chaseCNAME(q dns.Question, answer *source.Answer, client net.IPNet, recursion bool, t *source.Trace) bool {
+	if q.Qtype == dns.TypeCNAME || q.Qtype == dns.TypeANY {
+		return false
+	}
+
+	skipped := false
+	seen := map[string]bool{strings.ToLower(q.Name): true}
+	for len(seen) <= source.MaxChase {
+		// the last record should be a CNAME out of the source
+		if len(answer.An) == 0 || answer.Rcode != dns.RcodeSuccess {
+			break
+		}
+		cname, ok := answer.An[len(answer.An)-1].(*dns.CNAME)
+		if !ok {
+			break
+		}
+
+		target := strings.ToLower(cname.Target)
+		if seen[target] {
+			t.Addf("CNAME loop at %s", cname.Target)
+			break
+		}
+		seen[target] = true
+
+		t.Addf("follow CNAME to %s", cname.Target)
+		sub, s := v.lookup(dns.Question{Name: cname.Target, Qtype: q.Qtype, Qclass: q.Qclass}, client, recursion, t, 0)
+		skipped = skipped || s
+		if sub == nil || sub.Rcode == dns.RcodeRefused {
+			break
+		}
+
+		answer.An = append(answer.An, sub.An...)
+		answer.Ns = sub.Ns
+		answer.Ex = sub.Ex
+		answer.Rcode = sub.Rcode
+		answer.RA = answer.RA || sub.RA
+		answer.NoCache = answer.NoCache || sub.NoCache
+		answer.Recursive = answer.Recursive || sub.Recursive || v.recursive(sub.Source)
+	}
+	return skipped
+}
+
+// whether the named source is recursive
+func (v *view) recursive(name string) bool {
+	for i, n := range v.names {
+		if n == name {
+			return source.IsRecursive(v.sources[i])
+		}
+	}
+	return false
 }
 
 func makeErr(v ...interface{}) error {
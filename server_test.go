@@ -0,0 +1,276 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"go.papla.net/yuanxiao/source"
+)
+
+func testContext(t *testing.T, files map[string]string) *context {
+	dir := t.TempDir()
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("cannot write zone file: %s", err)
+		}
+	}
+
+	sources, names, err := loadSources("plain", map[string]string{"source.plain.path": dir})
+	if err != nil {
+		t.Fatalf("cannot load sources: %s", err)
+	}
+
+	acl, _ := NewACL("", "", "")
+	return &context{
+		def: &view{
+			name:    defaultView,
+			sources: sources,
+			names:   names,
+			ttls:    &ttlPolicies{},
+			cache:   NewCache(16, 0),
+		},
+		acl: acl,
+	}
+}
+
+func TestExplain(t *testing.T) {
+	ctx := testContext(t, map[string]string{
+		"default": "foo.com. 60 IN SOA ns.foo.com. root.foo.com. 1 3600 600 86400 60\n" +
+			"foo.com. 60 IN A 1.1.1.1\n",
+		"10.0.0.0.8": "foo.com. 60 IN A 2.2.2.2\n",
+	})
+
+	ip := net.ParseIP("10.1.1.1")
+	q := dns.Question{Name: "foo.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	tr := &source.Trace{}
+	res := ctx.process(&viewRequest{ip: ip}, q, hostSubnet(ip), tr)
+
+	if len(res.answer.An) != 1 || res.answer.An[0].(*dns.A).A.String() != "2.2.2.2" {
+		t.Errorf("unexpected answer: %v", res.answer.An)
+	}
+
+	// answers of subnet records are not cached for other clients
+	ctx.def.cache = NewCache(16, time.Minute)
+	ctx.process(&viewRequest{ip: ip}, q, hostSubnet(ip), nil)
+	other := net.ParseIP("192.168.1.1")
+	res = ctx.process(&viewRequest{ip: other}, q, hostSubnet(other), nil)
+	if len(res.answer.An) != 1 || res.answer.An[0].(*dns.A).A.String() != "1.1.1.1" {
+		t.Errorf("unexpected answer: %v", res.answer.An)
+	}
+
+	steps := strings.Join(tr.Steps, "\n")
+	for _, s := range []string{"view: default", "cache miss", "source plain: query", "subnet 10.0.0.0/8 matched"} {
+		if !strings.Contains(steps, s) {
+			t.Errorf("step not found: %s\n%s", s, steps)
+		}
+	}
+}
+
+// makes a view of plain sources, each has a file of content
+func testView(t *testing.T, contents ...string) *view {
+	v := &view{
+		name:  defaultView,
+		ttls:  &ttlPolicies{},
+		cache: NewCache(16, time.Minute),
+	}
+
+	for i, content := range contents {
+		dir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dir, "default"), []byte(content), 0644); err != nil {
+			t.Fatalf("cannot write zone file: %s", err)
+		}
+		s := source.New("plain")
+		if err := s.Reload(map[string]string{"path": dir}); err != nil {
+			t.Fatalf("cannot load source: %s", err)
+		}
+		v.sources = append(v.sources, s)
+		v.names = append(v.names, fmt.Sprintf("plain%d", i))
+	}
+	return v
+}
+
+func TestChaseCNAME(t *testing.T) {
+	v := testView(t,
+		"foo.com. 60 IN SOA ns.foo.com. root.foo.com. 1 3600 600 86400 60\n"+
+			"www.foo.com. 60 IN CNAME www.bar.com.\n",
+		"bar.com. 60 IN SOA ns.bar.com. root.bar.com. 1 3600 600 86400 60\n"+
+			"www.bar.com. 60 IN CNAME cdn.foo.com.\n",
+	)
+	q := dns.Question{Name: "www.foo.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	client := hostSubnet(net.ParseIP("10.1.1.1"))
+
+	a, _ := v.resolve(q, client, false, nil)
+	if len(a.An) != 1 {
+		t.Errorf("chased without option: %v", a.An)
+	}
+
+	v.chase = true
+	v.cache = NewCache(16, 0)
+	a, _ = v.resolve(q, client, false, nil)
+	if len(a.An) != 2 || a.Rcode != dns.RcodeNameError {
+		t.Errorf("unexpected answer: %v %s", a.An, dns.RcodeToString[a.Rcode])
+	}
+	if len(a.Ns) != 1 || a.Ns[0].Header().Name != "foo.com." {
+		t.Errorf("unexpected authority: %v", a.Ns)
+	}
+}
+
+func TestFitResponse(t *testing.T) {
+	a := &dns.Msg{}
+	a.SetQuestion("foo.com.", dns.TypeMX)
+	a.Authoritative = true
+	for i := 0; i < 40; i++ {
+		mx, _ := dns.NewRR(fmt.Sprintf("foo.com. 60 IN MX %d mail%d.foo.com.", i, i))
+		a.Answer = append(a.Answer, mx)
+		if i < 10 {
+			addr, _ := dns.NewRR(fmt.Sprintf("mail%d.foo.com. 60 IN A 10.0.0.%d", i, i))
+			a.Extra = append(a.Extra, addr)
+		}
+	}
+
+	// additional records are dropped first
+	b := a.Copy()
+	fitResponse(b, 1024)
+	if b.Truncated || len(b.Answer) != 40 || len(b.Extra) != 0 {
+		t.Errorf("unexpected response: tc %v, %d answer, %d additional", b.Truncated, len(b.Answer), len(b.Extra))
+	}
+
+	b = a.Copy()
+	fitResponse(b, dns.MinMsgSize)
+	if !b.Truncated || b.Len() > dns.MinMsgSize {
+		t.Errorf("response not truncated: %d bytes", b.Len())
+	}
+
+	// glue of referrals are kept with truncation
+	b = &dns.Msg{}
+	b.SetQuestion("www.foo.com.", dns.TypeA)
+	for i := 0; i < 10; i++ {
+		ns, _ := dns.NewRR(fmt.Sprintf("foo.com. 60 IN NS a-long-name-server-%d.foo.com.", i))
+		b.Ns = append(b.Ns, ns)
+		addr, _ := dns.NewRR(fmt.Sprintf("a-long-name-server-%d.foo.com. 60 IN AAAA 2001:db8::%d", i, i))
+		b.Extra = append(b.Extra, addr)
+	}
+	fitResponse(b, dns.MinMsgSize)
+	if !b.Truncated || len(b.Extra) == 0 {
+		t.Errorf("glue not kept: tc %v, %d additional", b.Truncated, len(b.Extra))
+	}
+}
+
+func TestAlias(t *testing.T) {
+	v := testView(t,
+		"foo.com. 60 IN SOA ns.foo.com. root.foo.com. 1 3600 600 86400 60\n"+
+			"foo.com. 60 IN ALIAS cdn.bar.net.\n"+
+			"www.foo.com. 60 IN ALIAS www.bar.net.\n",
+		"bar.net. 60 IN SOA ns.bar.net. root.bar.net. 1 3600 600 86400 60\n"+
+			"cdn.bar.net. 30 IN A 1.2.3.4\n",
+	)
+	client := hostSubnet(net.ParseIP("10.1.1.1"))
+
+	q := dns.Question{Name: "foo.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	a, _ := v.resolve(q, client, false, nil)
+	if len(a.An) != 1 || a.An[0].String() != "foo.com.\t30\tIN\tA\t1.2.3.4" || a.Ns != nil {
+		t.Errorf("unexpected answer: %v %v", a.An, a.Ns)
+	}
+	if a, ok := v.resolve(q, client, false, nil); !ok || len(a.An) != 1 {
+		t.Errorf("answer not cached: %v", a.An)
+	}
+
+	// no address of the type
+	q.Qtype = dns.TypeAAAA
+	a, _ = v.resolve(q, client, false, nil)
+	if len(a.An) != 0 || len(a.Ns) != 1 || a.Rcode != dns.RcodeSuccess {
+		t.Errorf("unexpected answer: %v %v", a.An, a.Ns)
+	}
+
+	q.Qtype = source.TypeALIAS
+	a, _ = v.resolve(q, client, false, nil)
+	if len(a.An) != 1 || a.An[0].String() != "foo.com.\t60\tIN\tALIAS\tcdn.bar.net." {
+		t.Errorf("unexpected answer: %v", a.An)
+	}
+
+	// target not found
+	q = dns.Question{Name: "www.foo.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	a, _ = v.resolve(q, client, false, nil)
+	if len(a.An) != 0 || len(a.Ns) != 1 || a.Rcode != dns.RcodeSuccess {
+		t.Errorf("unexpected answer: %v %v %s", a.An, a.Ns, dns.RcodeToString[a.Rcode])
+	}
+}
+
+func TestTsigResponse(t *testing.T) {
+	GlobalContext = testContext(t, map[string]string{
+		"default": "foo.com. 60 IN SOA ns.foo.com. root.foo.com. 1 3600 600 86400 60\n" +
+			"foo.com. 60 IN A 1.1.1.1\n",
+	})
+	defer func() { GlobalContext = nil }()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	secret := map[string]string{"key.": "c2VjcmV0"}
+	started := make(chan struct{})
+	s := &dns.Server{
+		PacketConn:        pc,
+		Handler:           dns.HandlerFunc(rootHandler),
+		TsigSecret:        secret,
+		NotifyStartedFunc: func() { close(started) },
+	}
+	go s.ActivateAndServe()
+	defer s.Shutdown()
+	<-started
+
+	m := &dns.Msg{}
+	m.SetQuestion("foo.com.", dns.TypeA)
+	m.SetEdns0(dns.DefaultMsgSize, false)
+	m.SetTsig("key.", dns.HmacSHA256, 300, time.Now().Unix())
+	c := &dns.Client{TsigSecret: secret}
+	r, _, err := c.Exchange(m, pc.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("query failed: %s", err)
+	}
+	if len(r.Answer) != 1 || r.IsTsig() == nil {
+		t.Errorf("response not signed: %v", r)
+	}
+}
+
+// a recursive source answering A records of any name
+type testRecursive struct{}
+
+func (r *testRecursive) Reload(o map[string]string) error { return nil }
+
+func (r *testRecursive) Recursive() bool { return true }
+
+func (r *testRecursive) Query(qname string, qtype uint16, client net.IPNet) *source.Answer {
+	rr, _ := dns.NewRR(qname + " 60 IN A 9.9.9.9")
+	return &source.Answer{An: []dns.RR{rr}, RA: true}
+}
+
+func TestChaseRecursive(t *testing.T) {
+	v := testView(t,
+		"foo.com. 60 IN SOA ns.foo.com. root.foo.com. 1 3600 600 86400 60\n"+
+			"www.foo.com. 60 IN CNAME cdn.example.net.\n",
+	)
+	v.sources = append(v.sources, &testRecursive{})
+	v.names = append(v.names, "relay")
+	v.chase = true
+	q := dns.Question{Name: "www.foo.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	client := hostSubnet(net.ParseIP("10.1.1.1"))
+
+	a, _ := v.resolve(q, client, true, nil)
+	if len(a.An) != 2 || !a.Recursive {
+		t.Fatalf("unexpected answer: %v", a.An)
+	}
+
+	// not served from cache without recursion
+	a, cached := v.resolve(q, client, false, nil)
+	if cached || len(a.An) != 1 {
+		t.Errorf("recursive answer from cache: %v", a.An)
+	}
+}
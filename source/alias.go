@@ -0,0 +1,77 @@
+// ALIAS record, to answer addresses of another name at zone apex
+package source
+
+import (
+	"github.com/miekg/dns"
+)
+
+// TypeALIAS is in the private use range, the same code as PowerDNS.
+const TypeALIAS uint16 = 65401
+
+func init() {
+	dns.PrivateHandle("ALIAS", TypeALIAS, func() dns.PrivateRdata { return &ALIAS{} })
+}
+
+// ALIAS is the rdata of an ALIAS record, the target must be fully
+// qualified in zone files.
+type ALIAS struct {
+	Target string
+}
+
+func (a *ALIAS) String() string {
+	return a.Target
+}
+
+func (a *ALIAS) Parse(txt []string) error {
+	if len(txt) != 1 {
+		return makeErr("invalid ALIAS record")
+	}
+
+	target := dns.Fqdn(txt[0])
+	if _, ok := dns.IsDomainName(target); !ok {
+		return makeErr("invalid ALIAS target: %s", txt[0])
+	}
+	a.Target = target
+	return nil
+}
+
+func (a *ALIAS) Pack(buf []byte) (int, error) {
+	return dns.PackDomainName(a.Target, buf, 0, nil, false)
+}
+
+func (a *ALIAS) Unpack(buf []byte) (int, error) {
+	var (
+		n   int
+		err error
+	)
+	a.Target, n, err = dns.UnpackDomainName(buf, 0)
+	return n, err
+}
+
+func (a *ALIAS) Copy(dest dns.PrivateRdata) error {
+	d, ok := dest.(*ALIAS)
+	if !ok {
+		return dns.ErrRdata
+	}
+	d.Target = a.Target
+	return nil
+}
+
+func (a *ALIAS) Len() int {
+	if a.Target == "." {
+		return 1
+	}
+	return len(a.Target) + 1
+}
+
+// target of the ALIAS record in rrs, empty if none
+func aliasTarget(rrs []dns.RR) string {
+	for _, rr := range rrs {
+		if v, ok := rr.(*dns.PrivateRR); ok {
+			if a, ok := v.Data.(*ALIAS); ok {
+				return a.Target
+			}
+		}
+	}
+	return ""
+}
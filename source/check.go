@@ -0,0 +1,355 @@
+// validate files of the plain source
+package source
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Problem is an issue found in files of a source, Line is 0 if not
+// known.
+type Problem struct {
+	File string
+	Line int
+	Msg  string
+}
+
+func (p *Problem) String() string {
+	if p.Line == 0 {
+		return fmt.Sprintf("%s: %s", p.File, p.Msg)
+	}
+	return fmt.Sprintf("%s:%d: %s", p.File, p.Line, p.Msg)
+}
+
+// a record and where it is, records of $INCLUDE are at the line of it
+type checkRecord struct {
+	rr   dns.RR
+	file string
+	line int
+}
+
+type plainChecker struct {
+	problems []*Problem
+	// records by owner name and subnet
+	names map[string]map[string][]*checkRecord
+}
+
+// CheckPlain loads files at path as the plain source does, and reports
+// all the problems found instead of stopping at the first one.
+func CheckPlain(path string) ([]*Problem, error) {
+	c := &plainChecker{names: make(map[string]map[string][]*checkRecord)}
+	if err := plainWalk(path, c.checkFile); err != nil {
+		return nil, err
+	}
+	c.checkNames()
+
+	sort.SliceStable(c.problems, func(i, j int) bool {
+		a, b := c.problems[i], c.problems[j]
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Msg < b.Msg
+	})
+	return c.problems, nil
+}
+
+func (c *plainChecker) addf(file string, line int, format string, v ...interface{}) {
+	c.problems = append(c.problems, &Problem{File: file, Line: line, Msg: fmt.Sprintf(format, v...)})
+}
+
+var parseErr = regexp.MustCompile(`^(?:(.*): )?(dns: .*) at line: (\d+):\d+$`)
+
+// state of the parser carried from one entry of a file to the next
+type checkState struct {
+	origin string
+	owner  string
+	ttl    uint32
+	hasTTL bool
+	// ttl is set by $TTL, instead of the last record
+	byDirective bool
+}
+
+func (c *plainChecker) checkFile(path, origin string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	sub, err := subnetOfName(filepath.Base(path))
+	if err != nil {
+		c.addf(path, 0, "%s", err)
+	}
+
+	// the parser stops at the first error, so each record or directive
+	// is parsed by itself to find all of them, with the state left by
+	// the ones before it.
+	st := &checkState{origin: origin}
+	lines := strings.SplitAfter(string(b), "\n")
+	for _, e := range zoneEntries(lines) {
+		c.checkEntry(path, sub, st, e.line, e.text)
+	}
+	return nil
+}
+
+func (c *plainChecker) checkEntry(path string, sub *net.IPNet, st *checkState, line int, text string) {
+	var prefix, probe string
+	if st.byDirective {
+		prefix = fmt.Sprintf("$TTL %d\n", st.ttl)
+	}
+	fields := strings.Fields(text)
+	directive := strings.ToUpper(fields[0])
+	switch directive {
+	case "$ORIGIN":
+		// a record at the new origin tells what it is
+		probe = "@ 0 IN TXT probe\n"
+	case "$TTL":
+		probe = "@ IN TXT probe\n"
+	default:
+		// owner of the last record
+		if (text[0] == ' ' || text[0] == '\t') && st.owner != "" {
+			text = st.owner + text
+		}
+	}
+	if !strings.HasSuffix(text, "\n") {
+		text += "\n"
+	}
+
+	zp := dns.NewZoneParser(strings.NewReader(prefix+text+probe), st.origin, path)
+	zp.SetIncludeAllowed(true)
+	if st.hasTTL && !st.byDirective {
+		zp.SetDefaultTTL(st.ttl)
+	}
+
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		h := rr.Header()
+		switch {
+		case directive == "$ORIGIN":
+			st.origin = h.Name
+			continue
+		case directive == "$TTL":
+			st.ttl, st.hasTTL, st.byDirective = h.Ttl, true, true
+			continue
+		case directive != "$INCLUDE":
+			st.owner = h.Name
+		}
+		if !st.byDirective {
+			st.ttl, st.hasTTL = h.Ttl, true
+		}
+
+		if _, err := parseAnnotation(zp.Comment()); err != nil {
+			c.addf(path, line, "%s: %s", rr, err)
+		}
+		c.add(rr, sub, path, line)
+	}
+
+	err := zp.Err()
+	if err == nil {
+		return
+	}
+	m := parseErr.FindStringSubmatch(err.Error())
+	if m == nil {
+		c.addf(path, line, "%s", err)
+		return
+	}
+	n, _ := strconv.Atoi(m[3])
+	// error in an included file
+	if m[1] != path {
+		c.addf(m[1], n, "%s", m[2])
+		return
+	}
+	c.addf(path, line+n-1-strings.Count(prefix, "\n"), "%s", m[2])
+}
+
+type zoneEntry struct {
+	line int
+	text string
+}
+
+// split lines of a zone file into records and directives, each spans
+// lines in parentheses. Blank lines and comments are left out.
+func zoneEntries(lines []string) []zoneEntry {
+	var entries []zoneEntry
+	var b strings.Builder
+	depth, start := 0, 0
+	for i, l := range lines {
+		if depth == 0 {
+			if t := strings.TrimSpace(l); t == "" || t[0] == ';' {
+				continue
+			}
+			start = i + 1
+		}
+		b.WriteString(l)
+
+		quoted := false
+	scan:
+		for j := 0; j < len(l); j++ {
+			switch {
+			case l[j] == '\\':
+				j++
+			case l[j] == '"':
+				quoted = !quoted
+			case quoted:
+			case l[j] == ';':
+				break scan
+			case l[j] == '(':
+				depth++
+			case l[j] == ')' && depth > 0:
+				depth--
+			}
+		}
+
+		if depth == 0 {
+			entries = append(entries, zoneEntry{line: start, text: b.String()})
+			b.Reset()
+		}
+	}
+	if b.Len() != 0 {
+		entries = append(entries, zoneEntry{line: start, text: b.String()})
+	}
+	return entries
+}
+
+func (c *plainChecker) add(rr dns.RR, sub *net.IPNet, file string, line int) {
+	name := strings.ToLower(rr.Header().Name)
+	subs := c.names[name]
+	if subs == nil {
+		subs = make(map[string][]*checkRecord)
+		c.names[name] = subs
+	}
+
+	for _, v := range subs[sub.String()] {
+		if dns.IsDuplicate(v.rr, rr) {
+			c.addf(file, line, "duplicate record: %s [%s]", rr, sub)
+			return
+		}
+	}
+	subs[sub.String()] = append(subs[sub.String()], &checkRecord{rr: rr, file: file, line: line})
+}
+
+func (c *plainChecker) checkNames() {
+	var names []string
+	apex := make(map[string]bool)
+	cut := make(map[string][]string)
+	for name, subs := range c.names {
+		names = append(names, name)
+		for _, rs := range subs {
+			for _, r := range rs {
+				switch v := r.rr.(type) {
+				case *dns.SOA:
+					apex[name] = true
+				case *dns.NS:
+					cut[name] = append(cut[name], strings.ToLower(v.Ns))
+				}
+			}
+		}
+	}
+	sort.Strings(names)
+
+	if len(apex) == 0 && len(names) > 0 {
+		r := c.first(names[0])
+		c.addf(r.file, r.line, "no SOA record found")
+	}
+
+	for _, name := range names {
+		c.checkCNAME(name)
+
+		if apex[name] {
+			if cut[name] == nil {
+				r := c.first(name)
+				c.addf(r.file, r.line, "%s: no NS record at zone apex", name)
+			}
+			continue
+		}
+
+		if len(apex) == 0 {
+			continue
+		}
+
+		// find the closest enclosing zone apex or delegation
+		labels := dns.SplitDomainName(name)
+		var parent string
+		for i := 0; i <= len(labels); i++ {
+			p := strings.Join(labels[i:], ".") + "."
+			if apex[p] || cut[p] != nil {
+				parent = p
+				break
+			}
+		}
+
+		switch {
+		case parent == "":
+			r := c.first(name)
+			c.addf(r.file, r.line, "%s: not in any zone, no SOA record at its apex", name)
+		case apex[parent]:
+		case parent == name:
+			c.checkRecords(name, func(rr dns.RR) bool {
+				t := rr.Header().Rrtype
+				return t == dns.TypeNS || t == dns.TypeDS
+			}, "data at delegation %s", parent)
+		default:
+			glue := false
+			for _, ns := range cut[parent] {
+				glue = glue || ns == name
+			}
+			c.checkRecords(name, func(rr dns.RR) bool {
+				t := rr.Header().Rrtype
+				return glue && (t == dns.TypeA || t == dns.TypeAAAA)
+			}, "out-of-zone data below delegation %s", parent)
+		}
+	}
+}
+
+// any record at name and subnet with CNAME must have no other data
+func (c *plainChecker) checkCNAME(name string) {
+	for sub, rs := range c.names[name] {
+		cname, other := 0, 0
+		var at *checkRecord
+		for _, r := range rs {
+			switch r.rr.Header().Rrtype {
+			case dns.TypeCNAME:
+				if at == nil {
+					at = r
+				}
+				cname++
+			case dns.TypeRRSIG, dns.TypeNSEC:
+			default:
+				other++
+			}
+		}
+		if cname > 1 || (cname > 0 && other > 0) {
+			c.addf(at.file, at.line, "%s: CNAME and other data [%s]", name, sub)
+		}
+	}
+}
+
+// report records at name not allowed by ok
+func (c *plainChecker) checkRecords(name string, ok func(dns.RR) bool, format string, v ...interface{}) {
+	for sub, rs := range c.names[name] {
+		for _, r := range rs {
+			if !ok(r.rr) {
+				c.addf(r.file, r.line, "%s: %s [%s]", fmt.Sprintf(format, v...), r.rr, sub)
+			}
+		}
+	}
+}
+
+// first record of name, to locate it
+func (c *plainChecker) first(name string) *checkRecord {
+	var keys []string
+	for k := range c.names[name] {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return c.names[name][keys[0]][0]
+}
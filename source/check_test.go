@@ -0,0 +1,75 @@
+package source
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckPlain(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"default": `
+foo.com. 60 IN SOA ns.foo.com. root.foo.com. 1 3600 600 86400 60
+foo.com. 60 IN NS ns.foo.com.
+ns.foo.com. 60 IN A 10.0.0.1
+www.foo.com. 60 IN A 10.0.0.2
+www.foo.com. 60 IN A 10.0.0.2
+www.foo.com. 60 IN A 10.0.0.300
+cn.foo.com. 60 IN CNAME www.foo.com.
+cn.foo.com. 60 IN A 10.0.0.3
+sub.foo.com. 60 IN NS ns.sub.foo.com.
+ns.sub.foo.com. 60 IN A 10.0.0.4
+x.sub.foo.com. 60 IN A 10.0.0.5
+bar.com. 60 IN SOA ns.foo.com. root.foo.com. 1 3600 600 86400 60
+www.baz.com. 60 IN BADTYPE 10.0.0.6
+www.qux.com. 60 IN A 10.0.0.10
+`,
+		// state of directives is kept after an error
+		"baz.net": `$ORIGIN baz.net.
+$TTL 300
+@ IN SOA ns root ( 1 3600 ; serial, refresh
+	600 86400 60 )
+  IN NS ns
+bad IN A 10.0.0.400
+ns IN A 10.0.0.1
+ns IN A 10.0.0.1
+`,
+		"10.0.0.1.8": "www.foo.com. 60 IN A 10.0.0.7\n",
+		"10.0.0.8":   "www.foo.com. 60 IN A 10.0.0.8\n",
+		".hidden":    "www.foo.com. 60 IN A 10.0.0.9\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ps, err := CheckPlain(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := []string{
+		"10.0.0.1.8: host bits set in subnet of name: 10.0.0.1.8",
+		"10.0.0.8: invalid subnet in name: 10.0.0.8",
+		`baz.net:6: dns: bad A A: "10.0.0.400"`,
+		"baz.net:8: duplicate record: ns.baz.net.\t300\tIN\tA\t10.0.0.1 [0.0.0.0/0]",
+		"default:6: duplicate record: www.foo.com.\t60\tIN\tA\t10.0.0.2 [0.0.0.0/0]",
+		`default:7: dns: bad A A: "10.0.0.300"`,
+		"default:8: cn.foo.com.: CNAME and other data [0.0.0.0/0]",
+		"default:12: out-of-zone data below delegation sub.foo.com.: x.sub.foo.com.\t60\tIN\tA\t10.0.0.5 [0.0.0.0/0]",
+		"default:13: bar.com.: no NS record at zone apex",
+		`default:14: dns: unknown RR type: "BADTYPE"`,
+		"default:15: www.qux.com.: not in any zone, no SOA record at its apex",
+	}
+
+	var got []string
+	for _, p := range ps {
+		got = append(got, strings.TrimPrefix(p.String(), dir+"/"))
+	}
+	if strings.Join(got, "\n") != strings.Join(expect, "\n") {
+		t.Errorf("got problems:\n%s\nexpect:\n%s", strings.Join(got, "\n"), strings.Join(expect, "\n"))
+	}
+}
@@ -4,7 +4,9 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"sort"
 	"strings"
+	"sync/atomic"
 
 	"github.com/miekg/dns"
 
@@ -20,18 +22,108 @@ type Source interface {
 	Query(qname string, qtype uint16, client net.IPNet) *Answer
 }
 
-var Sources = map[string]Source{}
+// Recursive is implemented by sources which answer queries by
+// recursion, such as relay.
+type Recursive interface {
+	Recursive() bool
+}
+
+func IsRecursive(s Source) bool {
+	r, ok := s.(Recursive)
+	return ok && r.Recursive()
+}
+
+// Trace records steps of resolving a query, a nil Trace records
+// nothing.
+type Trace struct {
+	Steps []string
+}
+
+func (t *Trace) Addf(format string, v ...interface{}) {
+	if t == nil {
+		return
+	}
+	t.Steps = append(t.Steps, fmt.Sprintf(format, v...))
+}
+
+// Explainer is implemented by sources which can trace their queries.
+type Explainer interface {
+	Explain(qname string, qtype uint16, client net.IPNet, t *Trace) *Answer
+}
+
+// Explain queries a source with trace if it supports.
+func Explain(s Source, qname string, qtype uint16, client net.IPNet, t *Trace) *Answer {
+	if e, ok := s.(Explainer); ok && t != nil {
+		return e.Explain(qname, qtype, client, t)
+	}
+	return s.Query(qname, qtype, client)
+}
+
+// Notifier is implemented by sources which know when their records
+// are changed, such as etcd by watches.
+type Notifier interface {
+	// Notify sets f to be called with names whose records are
+	// changed, records of the names below may be changed too.
+	Notify(f func(name string))
+}
+
+// Closer is implemented by sources holding connections or watches,
+// which are released when the sources are replaced by reloading.
+type Closer interface {
+	Close() error
+}
 
-func registerSource(name string, obj Source) {
-	Sources[name] = obj
+// Close releases a source if it supports.
+func Close(s Source) error {
+	if c, ok := s.(Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// constructors of builtin sources
+var Sources = map[string]func() Source{}
+
+func registerSource(name string, f func() Source) {
+	Sources[name] = f
 	log.Infof("register a source: %s", name)
 }
 
+// New makes a source by name, returns nil if not found. Sources made
+// are independent of each other, so one kind of source can be used
+// with different options at the same time.
+func New(name string) Source {
+	f := Sources[name]
+	if f == nil {
+		return nil
+	}
+	return f()
+}
+
 type Answer struct {
 	An, Ns, Ex []dns.RR
 	Rcode      int
 	Auth       bool
 	RA         bool
+
+	// name of the source giving this answer, set by server
+	Source string
+
+	// target of ALIAS, the server answers its addresses instead of
+	// the SOA in Ns.
+	Alias string
+
+	// the answer varies by query, such as records selected randomly
+	NoCache bool
+
+	// a recursive source gives part of the answer, such as the target
+	// of a CNAME chased by server, set by server.
+	Recursive bool
+
+	// names the answer is built from other than owners and targets of
+	// its records, such as the target of a flattened ALIAS, set by
+	// server to flush it on changes.
+	Depends []string
 }
 
 func makeErr(v ...interface{}) error {
@@ -44,6 +136,23 @@ func makeErr(v ...interface{}) error {
 	return errors.New(msg)
 }
 
+// parse a record in zone file format, with its comment
+func parseRR(s string) (dns.RR, string, error) {
+	var (
+		rr      dns.RR
+		comment string
+		err     error
+	)
+	for t := range dns.ParseZone(strings.NewReader(s), ".", "") {
+		if t.Error != nil {
+			err = t.Error
+		} else if rr == nil {
+			rr, comment = t.RR, t.Comment
+		}
+	}
+	return rr, comment, err
+}
+
 func commaSplit(s string) []string {
 	tok := strings.Split(s, ",")
 	var r []string
@@ -63,8 +172,60 @@ func reverseSlice(s []string) {
 	}
 }
 
+// nameTree is a node in a tree of names, such as the ones of the plain
+// source and the etcd mirror.
+type nameTree interface {
+	nodeRecords() *Srecords
+	eachSub(f func(label string, sub nameTree))
+}
+
+// collect names with records below n of name, and whether they have
+// a SOA record.
+func treeNames(n nameTree, name string, names map[string]bool) {
+	if r := n.nodeRecords(); !r.empty() {
+		names[name] = r.Get(dns.TypeSOA, allClients) != nil
+	}
+	n.eachSub(func(l string, sub nameTree) {
+		treeNames(sub, dns.Fqdn(l+"."+strings.TrimSuffix(name, ".")), names)
+	})
+}
+
+// names out of any zone, which are refused by queries. names are the
+// ones with records, and whether they have a SOA record.
+func zoneless(names map[string]bool) []string {
+	var r []string
+	for name := range names {
+		labels := dns.SplitDomainName(name)
+		in := false
+		for i := 0; i <= len(labels) && !in; i++ {
+			in = names[dns.Fqdn(strings.Join(labels[i:], "."))]
+		}
+		if !in {
+			r = append(r, name)
+		}
+	}
+	sort.Strings(r)
+	return r
+}
+
+// warn about records out of any zone when a source is loaded, as they
+// were answered before zones are required.
+func warnZoneless(s Source, root nameTree) {
+	names := make(map[string]bool)
+	treeNames(root, ".", names)
+	for _, name := range zoneless(names) {
+		log.Warnf("%s %s is not in any zone and refused, add a SOA record at its apex", s, name)
+	}
+}
+
+// max length of a CNAME chain to follow
+const MaxChase = 8
+
 type authBase struct {
 	authExt
+	trace *Trace
+	// names in the CNAME chain followed
+	chased []string
 }
 
 type authExt interface {
@@ -72,90 +233,212 @@ type authExt interface {
 	getRR(string, uint16, net.IPNet) []dns.RR
 }
 
-func (a *authBase) query(qname string, qtype uint16, client net.IPNet) *Answer {
-	ans := &Answer{}
+// implemented by sources with subnet records, to trace which subnet
+// is matched. Answers of names with subnet records vary by client so
+// should not be cached.
+type subnetExt interface {
+	matchSubnet(string, net.IPNet) *net.IPNet
+	hasSubnets(string) bool
+}
 
-	// change rr's name to qname
-	defer func() {
-		if ans == nil {
-			return
-		}
+// implemented by sources which select records by policies, answers
+// of such records vary by query so should not be cached.
+type selectExt interface {
+	selection(string, uint16, net.IPNet) string
+}
 
-		ans.An = a.applyName(ans.An, qname)
-		ans.Ns = a.applyName(ans.Ns, qname)
-		ans.Ex = a.applyName(ans.Ex, qname)
-	}()
+// records for all clients, which define the zones
+var allClients = net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)}
+
+// The zone of qname is the closest name with a SOA record, names out
+// of any zone are refused. Names below a NS record other than the apex
+// are referred with glue. Zones are defined by records for all
+// clients, so subnet records need not to repeat SOA and NS.
+func (a *authBase) query(qname string, qtype uint16, client net.IPNet) *Answer {
+	ans := &Answer{}
 
 	labels := dns.SplitDomainName(qname)
 	remains := a.findNode(qname)
+	a.trace.Addf("%s: %d labels not found", qname, remains)
 
-	switch remains {
-	// normal case
-	case 0:
-		rr := a.getRR(qname, qtype, client)
-		if rr == nil {
-			if qtype == dns.TypeCNAME {
-				ans.Rcode = dns.RcodeSuccess
-				return ans
-			}
+	// name of the ith ancestor, all the ancestors of the closest
+	// existing name exist.
+	name := func(i int) string {
+		return dns.Fqdn(strings.Join(labels[i:], "."))
+	}
 
-			// TODO: start a sub query internally
-			rr := a.getRR(qname, dns.TypeCNAME, client)
-			ans.An = rr
-			ans.Rcode = dns.RcodeSuccess
-			return ans
+	var soa []dns.RR
+	apex := -1
+	for i := remains; i <= len(labels); i++ {
+		if soa = a.getRR(name(i), dns.TypeSOA, allClients); soa != nil {
+			apex = i
+			break
 		}
+	}
+	if apex == -1 {
+		a.trace.Addf("%s: not in any zone", qname)
+		ans.Rcode = dns.RcodeRefused
+		return ans
+	}
+	a.trace.Addf("%s: in zone %s", qname, name(apex))
 
-		ans.An = rr
+	// look for zone cuts from the apex down, DS at a cut belongs to
+	// the parent zone.
+	for i := apex - 1; i >= remains; i-- {
+		if i == 0 && qtype == dns.TypeDS {
+			break
+		}
+
+		cut := name(i)
+		ns := a.getRR(cut, dns.TypeNS, allClients)
+		if ns == nil {
+			continue
+		}
+
+		a.trace.Addf("%s: delegated by %s", qname, cut)
+		ans.Ns = ns
+		ans.Ex = a.additional(cut, ns, client)
 		ans.Rcode = dns.RcodeSuccess
 		return ans
+	}
 
-	// need to check wildcard and domain delegation
-	case 1:
-		// check if already a wildcard query
-		if labels[0] == "*" {
-			ans.Rcode = dns.RcodeNameError
-			return ans
+	if remains == 0 {
+		return a.answer(qname, qname, qtype, soa, client)
+	}
+
+	// try wildcard at the closest encloser
+	wildcard := "*." + name(remains)
+	if remains == len(labels) {
+		wildcard = "*."
+	}
+	if a.findNode(wildcard) == 0 {
+		a.trace.Addf("%s: match wildcard %s", qname, wildcard)
+		return a.answer(qname, wildcard, qtype, soa, client)
+	}
+
+	a.trace.Addf("%s: name not found", qname)
+	ans.Ns = negativeSOA(soa)
+	ans.Rcode = dns.RcodeNameError
+	ans.Auth = true
+	return ans
+}
+
+// answer from records of an existing name, which is qname or the
+// wildcard matched.
+func (a *authBase) answer(qname, name string, qtype uint16, soa []dns.RR, client net.IPNet) *Answer {
+	ans := &Answer{Rcode: dns.RcodeSuccess, Auth: true}
+
+	if s, ok := a.authExt.(subnetExt); ok {
+		if a.trace != nil {
+			a.trace.Addf("%s: subnet %s matched for client %s",
+				name, s.matchSubnet(name, client), &client)
 		}
+		ans.NoCache = s.hasSubnets(name)
+	}
 
-		// try wildcard first
-		name := fmt.Sprintf("*.%s.", strings.Join(labels[remains:], "."))
-		ans = a.query(name, qtype, client)
-		if ans.Rcode != dns.RcodeNameError {
+	rr := a.getRR(name, qtype, client)
+	if rr == nil && (qtype == dns.TypeA || qtype == dns.TypeAAAA) {
+		if target := aliasTarget(a.getRR(name, TypeALIAS, client)); target != "" {
+			a.trace.Addf("%s: no %s record, ALIAS to %s", name, dns.TypeToString[qtype], target)
+			ans.Alias = target
+			ans.Ns = negativeSOA(soa)
 			return ans
 		}
-
-		name = fmt.Sprintf("%s.", strings.Join(labels[remains:], "."))
-		rr := a.getRR(name, dns.TypeNS, client)
+	}
+	if rr == nil && qtype != dns.TypeCNAME {
+		rr = a.getRR(name, dns.TypeCNAME, client)
 		if rr != nil {
-			ans.An = nil
-			ans.Ns = rr
-			ans.Ex = nil
-			ans.Rcode = dns.RcodeSuccess
+			a.trace.Addf("%s: no %s record, CNAME found", name, dns.TypeToString[qtype])
+			ans.An = a.applyName(rr, qname)
+			if qtype != dns.TypeANY {
+				a.chase(qname, ans, qtype, client)
+			}
 			return ans
 		}
+	}
 
-		ans.Rcode = dns.RcodeNameError
+	if rr == nil {
+		a.trace.Addf("%s: no %s record", name, dns.TypeToString[qtype])
+		ans.Ns = negativeSOA(soa)
 		return ans
+	}
 
-	// check domain delegation only
-	default:
-		name := fmt.Sprintf("%s.", strings.Join(labels[remains:], "."))
-		rr := a.getRR(name, dns.TypeNS, client)
-		if rr != nil {
-			ans.An = nil
-			ans.Ns = rr
-			ans.Ex = nil
-			ans.Rcode = dns.RcodeSuccess
-			return ans
+	if s, ok := a.authExt.(selectExt); ok {
+		if policy := s.selection(name, qtype, client); policy != "" {
+			a.trace.Addf("%s: records selected by %s", name, policy)
+			ans.NoCache = true
 		}
+	}
 
-		ans.Rcode = dns.RcodeNameError
-		return ans
+	ans.An = a.applyName(rr, qname)
+	ans.Ex = a.additional(soa[0].Header().Name, rr, client)
+	return ans
+}
+
+// follow the CNAME in ans within this source, the records of its
+// target are appended. The chain stops at a loop, a name out of the
+// zones or a referral, and the server or client may go on with it.
+func (a *authBase) chase(qname string, ans *Answer, qtype uint16, client net.IPNet) {
+	cname, ok := ans.An[0].(*dns.CNAME)
+	if !ok {
+		return
 	}
+	target := strings.ToLower(cname.Target)
 
-	panic("should not reach here")
-	//return ans
+	a.chased = append(a.chased, strings.ToLower(qname))
+	for _, v := range a.chased {
+		if v == target {
+			a.trace.Addf("%s: CNAME loop at %s", qname, cname.Target)
+			return
+		}
+	}
+	if len(a.chased) >= MaxChase {
+		a.trace.Addf("%s: CNAME chain longer than %d", qname, MaxChase)
+		return
+	}
+
+	a.trace.Addf("%s: follow CNAME to %s", qname, cname.Target)
+	sub := a.query(cname.Target, qtype, client)
+	if sub.Rcode == dns.RcodeRefused || !sub.Auth {
+		a.trace.Addf("%s: %s not answered by this source", qname, cname.Target)
+		return
+	}
+
+	ans.An = append(ans.An, sub.An...)
+	ans.Ns = sub.Ns
+	ans.Ex = sub.Ex
+	ans.Rcode = sub.Rcode
+	ans.NoCache = ans.NoCache || sub.NoCache
+}
+
+// address records of targets of NS, MX and SRV records, only targets
+// in zone are looked up.
+func (a *authBase) additional(zone string, rrs []dns.RR, client net.IPNet) []dns.RR {
+	var ex []dns.RR
+	seen := make(map[string]bool)
+	for _, rr := range rrs {
+		var target string
+		switch v := rr.(type) {
+		case *dns.NS:
+			target = v.Ns
+		case *dns.MX:
+			target = v.Mx
+		case *dns.SRV:
+			target = v.Target
+		default:
+			continue
+		}
+
+		target = strings.ToLower(target)
+		if seen[target] || !dns.IsSubDomain(zone, target) || a.findNode(target) != 0 {
+			continue
+		}
+		seen[target] = true
+
+		ex = append(ex, a.getRR(target, dns.TypeA, client)...)
+		ex = append(ex, a.getRR(target, dns.TypeAAAA, client)...)
+	}
+	return ex
 }
 
 func (a *authBase) applyName(list []dns.RR, qname string) []dns.RR {
@@ -176,13 +459,33 @@ func (a *authBase) applyName(list []dns.RR, qname string) []dns.RR {
 	return result
 }
 
+// SOA in negative answers has ttl of min(ttl, minimum), as rfc2308.
+func negativeSOA(soa []dns.RR) []dns.RR {
+	result := make([]dns.RR, len(soa))
+	for i, rr := range soa {
+		result[i] = rr
+		v, ok := rr.(*dns.SOA)
+		if ok && v.Minttl < v.Hdr.Ttl {
+			v = dns.Copy(v).(*dns.SOA)
+			v.Hdr.Ttl = v.Minttl
+			result[i] = v
+		}
+	}
+	return result
+}
+
 // subnet record support
 type srecord struct {
 	r []dns.RR
+	// weights and geo tags of records in r
+	w []int
+	g [][]string
 	n *net.IPNet
+	// selection policies by type
+	sel map[uint16]*selector
 }
 type Srecords struct {
-	d []*srecord
+	t subnetTrie
 }
 
 func NewSrecords() *Srecords {
@@ -190,63 +493,129 @@ func NewSrecords() *Srecords {
 }
 
 func (s *Srecords) Add(r dns.RR, n *net.IPNet) {
+	s.add(r, n, &annotation{weight: 1})
+}
+
+// AddComment adds a record with annotations in its comment.
+func (s *Srecords) AddComment(r dns.RR, n *net.IPNet, comment string) error {
+	a, err := parseAnnotation(comment)
+	if err != nil {
+		return err
+	}
+	s.add(r, n, a)
+	return nil
+}
+
+func (s *Srecords) add(r dns.RR, n *net.IPNet, a *annotation) {
 	header := r.Header()
-	match := false
-	for _, v := range s.d {
-		if n.String() == v.n.String() {
-			// check if records has a cname. (p15 of rfc1034)
-			if header.Rrtype == dns.TypeCNAME {
-				log.Infof("overwrite all the previous records by a CNAME record: %s", header.Name)
-				v.r = []dns.RR{r}
-			} else {
-				v.r = append(v.r, r)
-			}
-			match = true
-			break
-		}
+	v := s.t.get(n, func() *srecord {
+		return &srecord{n: n, sel: make(map[uint16]*selector)}
+	})
+
+	if header.Rrtype == dns.TypeCNAME && v.r != nil {
+		// check if records has a cname. (p15 of rfc1034)
+		log.Infof("overwrite all the previous records by a CNAME record: %s", header.Name)
+		v.r, v.w, v.g = nil, nil, nil
+		v.sel = make(map[uint16]*selector)
 	}
 
-	if !match {
-		s.d = append(s.d, &srecord{r: []dns.RR{r}, n: n})
+	v.r = append(v.r, r)
+	v.w = append(v.w, a.weight)
+	v.g = append(v.g, a.geo)
+	if sel := v.sel[header.Rrtype].update(a); sel != nil {
+		v.sel[header.Rrtype] = sel
 	}
 }
 
-func (s *Srecords) Get(qtype uint16, sn net.IPNet) []dns.RR {
-	var min *srecord
-	// find a subnet contains sn
-	for _, v := range s.d {
-		o1, _ := v.n.Mask.Size()
-		o2, _ := sn.Mask.Size()
-		if o1 > o2 {
-			continue
-		}
-		if !v.n.Contains(sn.IP) {
-			continue
-		}
+// empty tells whether no record is added
+func (s *Srecords) empty() bool {
+	t := &s.t
+	return t.all == nil && t.v4 == trieNode{} && t.v6 == trieNode{}
+}
 
-		if min == nil {
-			min = v
-			continue
-		}
+// bySubnet tells whether any record is for a subnet rather than all
+// clients.
+func (s *Srecords) bySubnet() bool {
+	t := &s.t
+	return t.v4 != trieNode{} || t.v6 != trieNode{}
+}
 
-		o3, _ := min.n.Mask.Size()
-		if o1 > o3 {
-			min = v
-			continue
+// Subnet returns the subnet matched for sn, nil if none.
+func (s *Srecords) Subnet(sn net.IPNet) *net.IPNet {
+	if r := s.find(sn); r != nil {
+		return r.n
+	}
+	return nil
+}
+
+// Selection returns the selection policy of records of qtype for sn,
+// geo if selected by location only, empty if all records are answered
+// in order.
+func (s *Srecords) Selection(qtype uint16, sn net.IPNet) string {
+	r := s.find(sn)
+	if r == nil {
+		return ""
+	}
+	if r.sel[qtype] != nil {
+		return r.sel[qtype].policy
+	}
+
+	for i, rr := range r.r {
+		if rr.Header().Rrtype == qtype && r.g[i] != nil {
+			return "geo"
 		}
 	}
+	return ""
+}
 
+func (s *Srecords) Get(qtype uint16, sn net.IPNet) []dns.RR {
+	return s.GetGeo(qtype, sn, nil)
+}
+
+// GetGeo gets records for a client in location of geo tags, from the
+// most specific. loc is called only if the records are tagged, as
+// looking up the location is costly.
+func (s *Srecords) GetGeo(qtype uint16, sn net.IPNet, loc func() []string) []dns.RR {
+	min := s.find(sn)
 	if min == nil {
 		return nil
 	}
 
-	var result []dns.RR
-	for _, rr := range min.r {
+	var (
+		result  []dns.RR
+		weights []int
+		tags    [][]string
+		tagged  bool
+	)
+	for i, rr := range min.r {
 		if rr.Header().Rrtype != qtype && qtype != dns.TypeANY {
 			continue
 		}
 
 		result = append(result, rr)
+		weights = append(weights, min.w[i])
+		tags = append(tags, min.g[i])
+		tagged = tagged || min.g[i] != nil
+	}
+
+	if tagged && qtype != dns.TypeANY {
+		var l []string
+		if loc != nil {
+			l = loc()
+		}
+		result, weights = geoFilter(result, weights, tags, l)
+	}
+
+	if sel := min.sel[qtype]; sel != nil && result != nil {
+		result = sel.apply(result, weights, sn.String(), atomic.AddUint32(&sel.next, 1)-1)
+		if len(result) == 0 {
+			return nil
+		}
 	}
 	return result
 }
+
+// find the smallest subnet contains sn
+func (s *Srecords) find(sn net.IPNet) *srecord {
+	return s.t.match(sn)
+}
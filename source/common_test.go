@@ -2,18 +2,14 @@ package source
 
 import (
 	"net"
+	"strings"
 	"testing"
 
 	"github.com/miekg/dns"
 )
 
 type ae struct {
-	remains []int
-	rr      []string
-
-	// internal counter
-	remIndex int
-	rrIndex  int
+	rr []string
 
 	// query
 	qname string
@@ -21,30 +17,43 @@ type ae struct {
 
 	// expect
 	an, ns, ex string
+	rcode      int
+	auth       bool
 }
 
-func (a *ae) findNode(qname string) int {
-	i := a.remIndex
-	if i >= len(a.remains) {
-		i = len(a.remains) - 1
+const aeSOA = "com. 60 SOA ns.com. root.com. 1 3600 600 86400 30"
+
+func (a *ae) records() []dns.RR {
+	var rrs []dns.RR
+	for _, s := range a.rr {
+		rr, _ := dns.NewRR(s)
+		rrs = append(rrs, rr)
 	}
-	a.remIndex++
-	return a.remains[i]
+	return rrs
 }
 
-func (a *ae) getRR(qname string, qtype uint16, ip net.IP) []dns.RR {
-	i := a.rrIndex
-	if i >= len(a.rr) {
-		i = len(a.rr) - 1
+func (a *ae) findNode(qname string) int {
+	labels := dns.SplitDomainName(strings.ToLower(qname))
+	for i := 0; i < len(labels); i++ {
+		name := dns.Fqdn(strings.Join(labels[i:], "."))
+		for _, rr := range a.records() {
+			if dns.IsSubDomain(name, rr.Header().Name) {
+				return i
+			}
+		}
 	}
+	return len(labels)
+}
 
-	rr, _ := dns.NewRR(a.rr[i])
-	if rr.Header().Rrtype != qtype {
-		return nil
+func (a *ae) getRR(qname string, qtype uint16, client net.IPNet) []dns.RR {
+	var result []dns.RR
+	for _, rr := range a.records() {
+		if rr.Header().Name == strings.ToLower(qname) &&
+			(rr.Header().Rrtype == qtype || qtype == dns.TypeANY) {
+			result = append(result, rr)
+		}
 	}
-
-	a.rrIndex++
-	return []dns.RR{rr}
+	return result
 }
 
 func normalize(s string) string {
@@ -70,13 +79,13 @@ func equalFirst(rr []dns.RR, s string) bool {
 }
 
 func checkBaseQuery(t *testing.T, a *ae) {
-	ab := &authBase{a}
+	ab := &authBase{authExt: a}
 
 	a.an = normalize(a.an)
 	a.ns = normalize(a.ns)
 	a.ex = normalize(a.ex)
 
-	ans := ab.query(a.qname, dns.StringToType[a.qtype], nil)
+	ans := ab.query(a.qname, dns.StringToType[a.qtype], net.IPNet{})
 	if !equalFirst(ans.An, a.an) {
 		t.Errorf("answer not equal: %s != %s", ans.An, a.an)
 	}
@@ -88,19 +97,28 @@ func checkBaseQuery(t *testing.T, a *ae) {
 	if !equalFirst(ans.Ex, a.ex) {
 		t.Errorf("additional not equal: %s != %s", ans.Ex, a.ex)
 	}
+
+	if ans.Rcode != a.rcode {
+		t.Errorf("rcode not equal: %s != %s", dns.RcodeToString[ans.Rcode], dns.RcodeToString[a.rcode])
+	}
+
+	if ans.Auth != a.auth {
+		t.Errorf("auth not equal: %v != %v", ans.Auth, a.auth)
+	}
 }
 
 func TestAuthBasic(t *testing.T) {
 	a := &ae{
-		remains: []int{0},
 		rr: []string{
-			" A 1.1.1.1",
+			aeSOA,
+			"foo.com. A 1.1.1.1",
 		},
-		qname: "foo.com.",
+		qname: "FOO.com.",
 		qtype: "A",
-		an:    "foo.com. A 1.1.1.1",
+		an:    "FOO.com. A 1.1.1.1",
 		ns:    "",
 		ex:    "",
+		auth:  true,
 	}
 
 	checkBaseQuery(t, a)
@@ -108,15 +126,16 @@ func TestAuthBasic(t *testing.T) {
 
 func TestAuthCname(t *testing.T) {
 	a := &ae{
-		remains: []int{0},
 		rr: []string{
-			" CNAME bar.com.",
+			aeSOA,
+			"foo.com. CNAME bar.net.",
 		},
 		qname: "foo.com.",
 		qtype: "A",
-		an:    "foo.com. CNAME bar.com.",
+		an:    "foo.com. CNAME bar.net.",
 		ns:    "",
 		ex:    "",
+		auth:  true,
 	}
 
 	checkBaseQuery(t, a)
@@ -124,32 +143,179 @@ func TestAuthCname(t *testing.T) {
 
 func TestAuthNs(t *testing.T) {
 	a := &ae{
-		remains: []int{1},
 		rr: []string{
-			" NS com.",
+			aeSOA,
+			"foo.com. NS ns.foo.com.",
+			"ns.foo.com. A 1.1.1.1",
+		},
+		qname: "www.foo.com.",
+		qtype: "A",
+		an:    "",
+		ns:    "foo.com. NS ns.foo.com.",
+		ex:    "ns.foo.com. A 1.1.1.1",
+		auth:  false,
+	}
+
+	checkBaseQuery(t, a)
+}
+
+func TestAuthWildcard(t *testing.T) {
+	a := &ae{
+		rr: []string{
+			aeSOA,
+			"*.foo.com. A 1.1.1.1",
+		},
+		qname: "bar.bar.foo.com.",
+		qtype: "A",
+		an:    "bar.bar.foo.com. A 1.1.1.1",
+		ns:    "",
+		ex:    "",
+		auth:  true,
+	}
+
+	checkBaseQuery(t, a)
+}
+
+func TestAuthNodata(t *testing.T) {
+	a := &ae{
+		rr: []string{
+			aeSOA,
+			"foo.com. A 1.1.1.1",
 		},
 		qname: "foo.com.",
+		qtype: "AAAA",
+		an:    "",
+		ns:    "com. 30 SOA ns.com. root.com. 1 3600 600 86400 30",
+		ex:    "",
+		auth:  true,
+	}
+
+	checkBaseQuery(t, a)
+}
+
+func TestAuthNxdomain(t *testing.T) {
+	a := &ae{
+		rr: []string{
+			aeSOA,
+			"foo.com. A 1.1.1.1",
+		},
+		qname: "bar.com.",
 		qtype: "A",
 		an:    "",
-		ns:    "foo.com. NS com.",
+		ns:    "com. 30 SOA ns.com. root.com. 1 3600 600 86400 30",
 		ex:    "",
+		rcode: dns.RcodeNameError,
+		auth:  true,
 	}
 
 	checkBaseQuery(t, a)
 }
 
-func TestAuthWildcard(t *testing.T) {
+func TestAuthRefused(t *testing.T) {
 	a := &ae{
-		remains: []int{1, 0},
 		rr: []string{
-			" A 1.1.1.1",
+			aeSOA,
+			"foo.net. A 1.1.1.1",
 		},
-		qname: "bar.foo.com.",
+		qname: "foo.net.",
 		qtype: "A",
-		an:    "bar.foo.com. A 1.1.1.1",
+		an:    "",
 		ns:    "",
 		ex:    "",
+		rcode: dns.RcodeRefused,
+		auth:  false,
 	}
 
 	checkBaseQuery(t, a)
 }
+
+func TestAuthChase(t *testing.T) {
+	a := &ae{
+		rr: []string{
+			aeSOA,
+			"foo.com. CNAME bar.com.",
+			"bar.com. CNAME baz.com.",
+			"baz.com. A 1.1.1.1",
+		},
+		qname: "foo.com.",
+		qtype: "A",
+	}
+
+	ans := (&authBase{authExt: a}).query(a.qname, dns.TypeA, net.IPNet{})
+	if len(ans.An) != 3 || ans.An[2].String() != normalize("baz.com. A 1.1.1.1") {
+		t.Errorf("chain not followed: %v", ans.An)
+	}
+
+	// loop
+	a.rr = []string{
+		aeSOA,
+		"foo.com. CNAME bar.com.",
+		"bar.com. CNAME foo.com.",
+	}
+	ans = (&authBase{authExt: a}).query(a.qname, dns.TypeA, net.IPNet{})
+	if len(ans.An) != 2 || ans.Rcode != dns.RcodeSuccess {
+		t.Errorf("loop not stopped: %v", ans.An)
+	}
+
+	// target out of zone
+	a.rr = []string{
+		aeSOA,
+		"foo.com. CNAME foo.net.",
+	}
+	ans = (&authBase{authExt: a}).query(a.qname, dns.TypeA, net.IPNet{})
+	if len(ans.An) != 1 || ans.Rcode != dns.RcodeSuccess || !ans.Auth {
+		t.Errorf("unexpected answer: %v %s", ans.An, dns.RcodeToString[ans.Rcode])
+	}
+
+	// target not found
+	a.rr = []string{
+		aeSOA,
+		"foo.com. CNAME bar.com.",
+	}
+	ans = (&authBase{authExt: a}).query(a.qname, dns.TypeA, net.IPNet{})
+	if len(ans.An) != 1 || ans.Rcode != dns.RcodeNameError || len(ans.Ns) != 1 {
+		t.Errorf("unexpected answer: %v %s", ans.An, dns.RcodeToString[ans.Rcode])
+	}
+}
+
+func TestAuthAdditional(t *testing.T) {
+	a := &ae{
+		rr: []string{
+			aeSOA,
+			"foo.com. MX 10 mail.foo.com.",
+			"foo.com. MX 20 mail.foo.net.",
+			"mail.foo.com. A 1.1.1.1",
+			"mail.foo.com. AAAA ::1",
+		},
+		qname: "foo.com.",
+		qtype: "MX",
+		an:    "foo.com. MX 10 mail.foo.com.",
+		ns:    "",
+		ex:    "mail.foo.com. A 1.1.1.1",
+		auth:  true,
+	}
+
+	checkBaseQuery(t, a)
+
+	ans := (&authBase{authExt: a}).query(a.qname, dns.TypeMX, net.IPNet{})
+	if len(ans.Ex) != 2 {
+		t.Errorf("unexpected additional: %v", ans.Ex)
+	}
+}
+
+func TestZoneless(t *testing.T) {
+	names := map[string]bool{
+		"foo.com.":      true,
+		"www.foo.com.":  false,
+		"bar.com.":      false,
+		"www.bar.com.":  false,
+		"a.b.foo.com.":  false,
+		"foo.com.cn.":   false,
+		"zone.foo.net.": true,
+	}
+
+	r := zoneless(names)
+	if len(r) != 3 || r[0] != "bar.com." || r[1] != "foo.com.cn." || r[2] != "www.bar.com." {
+		t.Errorf("unexpected names: %v", r)
+	}
+}
@@ -1,6 +1,7 @@
 package source
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"strconv"
@@ -8,31 +9,55 @@ import (
 	"sync"
 	"time"
 
-	client "github.com/coreos/go-etcd/etcd"
+	v2 "github.com/coreos/go-etcd/etcd"
 	"github.com/golang/groupcache/lru"
 	"github.com/miekg/dns"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/client/pkg/v3/transport"
+	client "go.etcd.io/etcd/client/v3"
+
+	"go.papla.net/goutil/log"
 )
 
 func init() {
-	registerSource("etcd", &etcd{})
+	registerSource("etcd", func() Source { return &etcd{} })
 }
 
 type etcd struct {
 	machines  []string
+	prefix    string
+	timeout   time.Duration
 	client    *client.Client
 	cachesize int
 	cachettl  time.Duration
+	geo       *geoDB
 	init      bool
 
+	// all the keys in memory if not nil, saved to snapshot
+	mirror   *mirror
+	snapshot string
+
 	cl    sync.Mutex
 	cache *lru.Cache
+	// increased when the cache is invalidated, keys read before it
+	// are not cached.
+	gen    uint64
+	notify func(name string)
+	// stops the watch
+	cancel context.CancelFunc
 
 	sync.RWMutex
 }
 
+// keys of a name are read in pages of this size.
+const etcdPage = 64
+
+// keys of a name, and whether it or any name below it has keys.
 type entry struct {
-	r      *client.Response
-	expire time.Time
+	kvs     []*mvccpb.KeyValue
+	exists  bool
+	records *Srecords
+	expire  time.Time
 }
 
 func (e *etcd) String() string {
@@ -43,24 +68,21 @@ func (e *etcd) Reload(o map[string]string) error {
 	var (
 		key       string
 		err       error
-		machines  []string
 		cli       *client.Client
+		timeout   time.Duration
 		cachesize int
 		cachettl  time.Duration
+		geo       *geoDB
+		mirrored  bool
 	)
 
-	key = "machines"
+	key = "timeout"
 	v := o[key]
-	if v == "" {
+	timeout, err = time.ParseDuration(v)
+	if err != nil {
 		return makeErr("%s option value error: %s", e, key)
 	}
 
-	machines = commaSplit(v)
-	cli = client.NewClient(machines)
-	if cli == nil {
-		return makeErr("%s cannot make client: %s", e, key)
-	}
-
 	key = "cache.size"
 	v = o[key]
 	cachesize, err = strconv.Atoi(v)
@@ -75,19 +97,228 @@ func (e *etcd) Reload(o map[string]string) error {
 		return makeErr("%s option value error: %s", e, key)
 	}
 
+	key = "mirror"
+	if v = o[key]; v != "" {
+		mirrored, err = strconv.ParseBool(v)
+		if err != nil {
+			return makeErr("%s option value error: %s", e, key)
+		}
+	}
+
+	geo, err = newGeoDB(o["geo.path"])
+	if err != nil {
+		return err
+	}
+
+	cli, err = newEtcdClient(o)
+	if err != nil {
+		return err
+	}
+
 	// all done
 	e.Lock()
 	defer e.Unlock()
-	e.machines = machines
+	e.close()
+	e.machines = cli.Endpoints()
+	e.prefix = strings.TrimSuffix(o["prefix"], "/")
+	e.timeout = timeout
 	e.client = cli
 	e.cachesize = cachesize
 	e.cachettl = cachettl
+	e.geo = geo
+	e.cl.Lock()
 	e.cache = lru.New(e.cachesize)
+	e.gen++
+	e.cl.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	e.cancel = cancel
+	e.mirror = nil
+	e.snapshot = o["mirror.snapshot"]
+	if !mirrored {
+		go e.watch(ctx, cli, e.prefix+"/")
+		go e.checkZones(ctx, cli)
+		e.init = true
+		return nil
+	}
+
+	// serve the snapshot, or nothing, until etcd is reachable
+	e.mirror = &mirror{root: newMirrorNode()}
+	if err := e.mirrorLoad(ctx, cli); err != nil {
+		log.Warnf("%s cannot load mirror: %s", e, err)
+		if !e.mirrorTakeOver() && e.snapshot != "" {
+			if err := e.mirrorRestore(e.snapshot); err != nil {
+				log.Warnf("%s cannot restore mirror: %s", e, err)
+			}
+		}
+	}
+	mirrors.Lock()
+	mirrors.m[e.mirrorKey()] = e.mirror
+	mirrors.Unlock()
+	go e.mirrorSync(ctx, cli)
+
 	e.init = true
 	return nil
 }
 
+// warn about names out of any zone by reading all the keys once, as
+// names are read on demand otherwise.
+func (e *etcd) checkZones(ctx context.Context, cli *client.Client) {
+	ctx, cancel := context.WithTimeout(ctx, e.timeout)
+	r, err := cli.Get(ctx, e.prefix+"/", client.WithPrefix())
+	cancel()
+	if err != nil {
+		log.Warnf("%s cannot check zones: %s", e, err)
+		return
+	}
+
+	warnZoneless(e, e.mirrorTree(r.Kvs))
+}
+
+func (e *etcd) Close() error {
+	e.Lock()
+	defer e.Unlock()
+	return e.close()
+}
+
+func (e *etcd) close() error {
+	if e.cancel != nil {
+		e.cancel()
+	}
+	if e.mirror != nil {
+		// the snapshot is left to the source replacing this one
+		mirrors.Lock()
+		last := mirrors.m[e.mirrorKey()] == e.mirror
+		if last {
+			delete(mirrors.m, e.mirrorKey())
+		}
+		mirrors.Unlock()
+
+		if last && e.snapshot != "" {
+			if err := e.mirrorDump(e.snapshot); err != nil {
+				log.Warnf("%s cannot save mirror snapshot: %s", e, err)
+			}
+		}
+	}
+	if e.client != nil {
+		return e.client.Close()
+	}
+	return nil
+}
+
+func (e *etcd) Notify(f func(name string)) {
+	e.cl.Lock()
+	e.notify = f
+	e.cl.Unlock()
+}
+
+// watch keys under prefix and invalidate names of changed keys. All
+// the names are invalidated if events may be lost, such as the
+// revision watched is compacted.
+func (e *etcd) watch(ctx context.Context, cli *client.Client, prefix string) {
+	for ctx.Err() == nil {
+		for r := range cli.Watch(client.WithRequireLeader(ctx), prefix, client.WithPrefix()) {
+			if err := r.Err(); err != nil {
+				log.Warnf("%s watch error: %s", e, err)
+				continue
+			}
+			for _, ev := range r.Events {
+				e.invalidate(e.keyName(string(ev.Kv.Key)))
+			}
+		}
+
+		if ctx.Err() == nil {
+			log.Warnf("%s watch stopped, start again", e)
+			e.invalidate(".")
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Second):
+			}
+		}
+	}
+}
+
+// name of a record key, such as foo.com. for /com/foo/1 and
+// /com/foo/@10.0.0.0.8/1
+func (e *etcd) keyName(key string) string {
+	labels := strings.Split(strings.TrimPrefix(key, e.prefix+"/"), "/")
+	labels = labels[:len(labels)-1]
+	if n := len(labels); n > 0 && strings.HasPrefix(labels[n-1], "@") {
+		labels = labels[:n-1]
+	}
+	reverseSlice(labels)
+	return dns.Fqdn(strings.ToLower(strings.Join(labels, ".")))
+}
+
+// drop cached keys of name, and of its ancestors without keys, which
+// may exist or not by the keys of name. The root invalidates all.
+func (e *etcd) invalidate(name string) {
+	labels := dns.SplitDomainName(name)
+
+	e.cl.Lock()
+	if labels == nil {
+		e.cache = lru.New(e.cachesize)
+	}
+	for i := range labels {
+		dir := e.dir(labels[i:])
+		if v, ok := e.cache.Get(dir); i == 0 || ok && v.(*entry).kvs == nil {
+			e.cache.Remove(dir)
+		}
+	}
+	e.gen++
+	notify := e.notify
+	e.cl.Unlock()
+
+	log.Debugf("%s %s changed", e, name)
+	if notify != nil {
+		notify(name)
+	}
+}
+
+// newEtcdClient makes a v3 client by options machines, tls.cert,
+// tls.key, tls.ca, username and password. Connections are made in
+// background, so it does not fail if the cluster is down.
+func newEtcdClient(o map[string]string) (*client.Client, error) {
+	e := &etcd{}
+
+	key := "machines"
+	v := o[key]
+	if v == "" {
+		return nil, makeErr("%s option value error: %s", e, key)
+	}
+
+	config := client.Config{
+		Endpoints:   commaSplit(v),
+		DialTimeout: 5 * time.Second,
+		Username:    o["username"],
+		Password:    o["password"],
+	}
+
+	if o["tls.cert"] != "" || o["tls.ca"] != "" {
+		info := transport.TLSInfo{
+			CertFile:      o["tls.cert"],
+			KeyFile:       o["tls.key"],
+			TrustedCAFile: o["tls.ca"],
+		}
+		tls, err := info.ClientConfig()
+		if err != nil {
+			return nil, makeErr("%s option value error: tls: %s", e, err)
+		}
+		config.TLS = tls
+	}
+
+	cli, err := client.New(config)
+	if err != nil {
+		return nil, makeErr("%s cannot make client: %s", e, err)
+	}
+	return cli, nil
+}
+
 func (e *etcd) Query(qname string, qtype uint16, client net.IPNet) *Answer {
+	return e.Explain(qname, qtype, client, nil)
+}
+
+func (e *etcd) Explain(qname string, qtype uint16, client net.IPNet, t *Trace) *Answer {
 	if !e.init {
 		panic(ErrSourceNotInit.Error())
 	}
@@ -95,85 +326,264 @@ func (e *etcd) Query(qname string, qtype uint16, client net.IPNet) *Answer {
 	e.RLock()
 	defer e.RUnlock()
 
-	a := &authBase{e}
+	a := &authBase{authExt: e, trace: t}
 	ans := a.query(qname, qtype, client)
-	ans.Auth = true
 	ans.RA = false
 	return ans
 }
 
-func (e *etcd) Get(key string) *client.Response {
+// directory of a name, labels are in reverse order and each ends with
+// '/', such as /com/foo/ for foo.com.
+func (e *etcd) dir(labels []string) string {
+	var b strings.Builder
+	b.WriteString(e.prefix)
+	b.WriteString("/")
+	for i := len(labels) - 1; i >= 0; i-- {
+		b.WriteString(labels[i])
+		b.WriteString("/")
+	}
+	return b.String()
+}
+
+// entry of the keys of a name under dir, its records for all the
+// clients and the ones under @subnet. The root is never read, as its
+// range covers all the keys.
+func (e *etcd) entry(dir string) *entry {
+	if dir == e.prefix+"/" {
+		return &entry{}
+	}
+
 	e.cl.Lock()
-	v, ok := e.cache.Get(key)
+	v, ok := e.cache.Get(dir)
+	gen := e.gen
 	e.cl.Unlock()
-	var item *entry
+	var stale *entry
 	if ok {
-		item = v.(*entry)
-		if item.expire.Before(time.Now()) {
-			return item.r
+		stale = v.(*entry)
+		if stale.expire.After(time.Now()) {
+			return stale
 		}
 	}
 
-	item = &entry{}
-	r, err := e.client.Get(key, false, false)
+	item, err := e.read(dir)
 	if err != nil {
-		item.r = nil
-	} else {
-		item.r = r
+		// serve the expired keys if any, and read again next time
+		log.Warnf("%s cannot get %s: %s", e, dir, err)
+		if stale != nil {
+			return stale
+		}
+		return &entry{}
 	}
+
 	item.expire = time.Now().Add(e.cachettl)
 	e.cl.Lock()
-	e.cache.Add(key, item)
+	// keys may be changed while reading
+	if gen == e.gen {
+		e.cache.Add(dir, item)
+	}
 	e.cl.Unlock()
-	return item.r
+	return item
+}
+
+// read the keys of a name a page at a time. The range of each name
+// below it is jumped over at its first key, which only tells the name
+// exists, so a zone apex is read without the whole zone.
+func (e *etcd) read(dir string) (*entry, error) {
+	item := &entry{}
+	key, end := dir, client.GetPrefixRangeEnd(dir)
+	opts := []client.OpOption{client.WithRange(end), client.WithLimit(etcdPage)}
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), e.timeout)
+		r, err := e.client.Get(ctx, key, opts...)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		if len(r.Kvs) == 0 {
+			return item, nil
+		}
+		item.exists = true
+
+		// later pages are read at the same revision
+		if len(opts) == 2 {
+			opts = append(opts, client.WithRev(r.Header.Revision))
+		}
+
+		next := ""
+		for _, kv := range r.Kvs {
+			k := string(kv.Key)
+			if k < next {
+				continue
+			}
+			rest := strings.TrimPrefix(k, dir)
+			i := strings.IndexByte(rest, '/')
+			if i < 0 || rest[0] == '@' {
+				item.kvs = append(item.kvs, kv)
+				continue
+			}
+			// '0' is the byte after '/'
+			next = dir + rest[:i] + "0"
+		}
+		if !r.More {
+			return item, nil
+		}
+
+		key = string(r.Kvs[len(r.Kvs)-1].Key) + "\x00"
+		if next > key {
+			key = next
+		}
+	}
 }
 
 func (e *etcd) findNode(qname string) int {
+	if e.mirror != nil {
+		return e.mirror.findNode(qname)
+	}
+
 	qname = strings.ToLower(qname)
 	labels := dns.SplitDomainName(qname)
-	reverseSlice(labels)
 
-	for i := len(labels); i >= 0; i-- {
-		key := strings.Join(labels[:i], "/")
-		r := e.Get(key)
-		if r == nil {
-			continue
+	for i := 0; i <= len(labels); i++ {
+		if e.entry(e.dir(labels[i:])).exists {
+			return i
 		}
-
-		return len(labels) - i
 	}
 
 	return len(labels)
 }
 
 func (e *etcd) getRR(qname string, qtype uint16, client net.IPNet) []dns.RR {
-	qname = strings.ToLower(qname)
-	labels := dns.SplitDomainName(qname)
-	reverseSlice(labels)
-	key := strings.Join(labels, "/")
+	return e.records(qname).GetGeo(qtype, client, func() []string {
+		return e.geo.lookup(client.IP)
+	})
+}
 
-	r := e.Get(key)
-	if r == nil {
-		return nil
+func (e *etcd) matchSubnet(qname string, client net.IPNet) *net.IPNet {
+	return e.records(qname).Subnet(client)
+}
+
+func (e *etcd) hasSubnets(qname string) bool {
+	return e.records(qname).bySubnet()
+}
+
+func (e *etcd) selection(qname string, qtype uint16, client net.IPNet) string {
+	return e.records(qname).Selection(qtype, client)
+}
+
+// records of a name, built from values under its key and kept with
+// the cached keys, so round robin goes on between lookups.
+func (e *etcd) records(qname string) *Srecords {
+	if e.mirror != nil {
+		return e.mirror.records(qname)
 	}
 
-	if r.Node.Nodes == nil {
-		return nil
+	qname = strings.ToLower(dns.Fqdn(qname))
+	dir := e.dir(dns.SplitDomainName(qname))
+	item := e.entry(dir)
+
+	e.cl.Lock()
+	s := item.records
+	e.cl.Unlock()
+	if s != nil {
+		return s
 	}
 
-	var result []dns.RR
-	for _, n := range r.Node.Nodes {
-		rr, err := dns.NewRR(n.Value)
-		if err != nil || rr == nil {
+	s = NewSrecords()
+	e.addRecords(s, qname, dir, item.kvs)
+
+	e.cl.Lock()
+	if item.records == nil {
+		item.records = s
+	}
+	s = item.records
+	e.cl.Unlock()
+	return s
+}
+
+// add records of a name in values of keys under its dir. Records for
+// all the clients are right under dir, and records of a subnet are in
+// @address.prefixlen under it, such as @10.0.0.0.8 for 10.0.0.0/8.
+// Keys of names below are skipped.
+func (e *etcd) addRecords(s *Srecords, qname, dir string, kvs []*mvccpb.KeyValue) {
+	for _, kv := range kvs {
+		key := string(kv.Key)
+		sub := &net.IPNet{IP: allClients.IP, Mask: allClients.Mask}
+
+		rest := strings.Split(strings.TrimPrefix(key, dir), "/")
+		switch {
+		case len(rest) == 1:
+		case len(rest) == 2 && strings.HasPrefix(rest[0], "@"):
+			// not to serve records of a wrong subnet to all
+			var err error
+			if sub, err = parseSubnetName(rest[0][1:]); err != nil {
+				log.Warnf("%s %s: %s, skipped", e, key, err)
+				continue
+			}
+		default:
 			continue
 		}
 
-		if rr.Header().Rrtype != qtype && qtype != dns.TypeANY {
+		rr, comment, err := parseRR(string(kv.Value))
+		if err != nil || rr == nil {
+			log.Warnf("%s %s: invalid record: %s", e, key, kv.Value)
 			continue
 		}
 
-		result = append(result, rr)
+		// values may leave out the owner, which is the name of the key
+		rr.Header().Name = qname
+
+		if err := s.AddComment(rr, sub, comment); err != nil {
+			log.Warnf("%s %s: %s", e, key, err)
+			s.Add(rr, sub)
+		}
+	}
+}
+
+// EtcdMigrate copies records in a v2 tree to v3 keys of the same
+// path, the v3 cluster is set by options of the etcd source. It
+// returns the number of keys copied.
+func EtcdMigrate(machines []string, o map[string]string) (int, error) {
+	r, err := v2.NewClient(machines).Get("/", false, true)
+	if err != nil {
+		return 0, makeErr("cannot read v2 tree: %s", err)
+	}
+
+	cli, err := newEtcdClient(o)
+	if err != nil {
+		return 0, err
 	}
+	defer cli.Close()
 
-	return result
+	prefix := strings.TrimSuffix(o["prefix"], "/")
+	return etcdMigrateNode(r.Node, func(key, value string) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, err := cli.Put(ctx, prefix+key, value)
+		return err
+	})
+}
+
+// copy values of n and nodes below by put, directories are left out
+// as v3 has none.
+func etcdMigrateNode(n *v2.Node, put func(key, value string) error) (int, error) {
+	if n == nil {
+		return 0, nil
+	}
+
+	if !n.Dir {
+		if err := put(n.Key, n.Value); err != nil {
+			return 0, makeErr("cannot put %s: %s", n.Key, err)
+		}
+		return 1, nil
+	}
+
+	count := 0
+	for _, sub := range n.Nodes {
+		c, err := etcdMigrateNode(sub, put)
+		count += c
+		if err != nil {
+			return count, err
+		}
+	}
+	return count, nil
 }
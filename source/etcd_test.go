@@ -0,0 +1,355 @@
+package source
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	v2 "github.com/coreos/go-etcd/etcd"
+	"github.com/miekg/dns"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	client "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/server/v3/embed"
+)
+
+// starts an embedded etcd server, returns its client endpoint.
+func testEtcdServer(t *testing.T) string {
+	free := func() url.URL {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("cannot listen: %s", err)
+		}
+		defer l.Close()
+		return url.URL{Scheme: "http", Host: l.Addr().String()}
+	}
+
+	cfg := embed.NewConfig()
+	cfg.Dir = t.TempDir()
+	cfg.LogLevel = "error"
+	peer, client := free(), free()
+	cfg.ListenPeerUrls = []url.URL{peer}
+	cfg.AdvertisePeerUrls = []url.URL{peer}
+	cfg.ListenClientUrls = []url.URL{client}
+	cfg.AdvertiseClientUrls = []url.URL{client}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+
+	s, err := embed.StartEtcd(cfg)
+	if err != nil {
+		t.Fatalf("cannot start etcd: %s", err)
+	}
+	t.Cleanup(s.Close)
+
+	select {
+	case <-s.Server.ReadyNotify():
+	case <-time.After(10 * time.Second):
+		t.Fatalf("etcd not ready")
+	}
+	return client.String()
+}
+
+// options of an etcd source with prefix /dns
+func testEtcdOptions(machines string) map[string]string {
+	return map[string]string{
+		"machines":   machines,
+		"prefix":     "/dns",
+		"timeout":    "2s",
+		"cache.size": "16",
+		"cache.ttl":  "1m",
+	}
+}
+
+// makes an etcd source with options o
+func testEtcdSource(t *testing.T, o map[string]string) *etcd {
+	e := &etcd{}
+	if err := e.Reload(o); err != nil {
+		t.Fatalf("cannot load source: %s", err)
+	}
+	t.Cleanup(func() { e.Close() })
+	return e
+}
+
+// put keys under the prefix /dns, or delete them if values are empty
+func testEtcdPut(t *testing.T, cli *client.Client, kvs map[string]string) {
+	for k, v := range kvs {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		var err error
+		if v != "" {
+			_, err = cli.Put(ctx, "/dns"+k, v)
+		} else {
+			_, err = cli.Delete(ctx, "/dns"+k)
+		}
+		cancel()
+		if err != nil {
+			t.Fatalf("cannot change %s: %s", k, err)
+		}
+	}
+}
+
+// makes an etcd source with keys
+func testEtcd(t *testing.T, kvs map[string]string) *etcd {
+	e := testEtcdSource(t, testEtcdOptions(testEtcdServer(t)))
+	testEtcdPut(t, e.client, kvs)
+	return e
+}
+
+func TestEtcdQuery(t *testing.T) {
+	e := testEtcd(t, map[string]string{
+		"/com/foo/1":             "foo.com. 60 IN SOA ns.foo.com. root.foo.com. 1 3600 600 86400 60",
+		"/com/foo/2":             " 30 A 1.1.1.1",
+		"/com/foo/3":             "bar.com. 30 A 1.1.1.2 ; select=roundrobin",
+		"/com/foo/4":             "not a record",
+		"/com/foo/@10.0.0.0.8/1": " 30 A 2.2.2.2",
+		"/com/foo/www/1":         " 30 A 3.3.3.3",
+		// skipped, not for all clients
+		"/com/foo/@10.0.0.8/1": " 30 A 4.4.4.4",
+		"/com/foo/@foo/1":      " 30 A 5.5.5.5",
+	})
+
+	other := net.IPNet{IP: net.IPv4(192, 168, 0, 1), Mask: net.CIDRMask(32, 32)}
+	a := e.Query("foo.com.", dns.TypeA, other)
+	if len(a.An) != 2 || !a.Auth || !a.NoCache {
+		t.Fatalf("unexpected answer: %v", a.An)
+	}
+	for _, rr := range a.An {
+		if rr.Header().Name != "foo.com." {
+			t.Errorf("owner not set: %s", rr)
+		}
+	}
+
+	sn := net.IPNet{IP: net.IPv4(10, 1, 1, 1), Mask: net.CIDRMask(32, 32)}
+	a = e.Query("foo.com.", dns.TypeA, sn)
+	if len(a.An) != 1 || a.An[0].(*dns.A).A.String() != "2.2.2.2" || !a.NoCache {
+		t.Errorf("unexpected answer: %v", a.An)
+	}
+	if e.matchSubnet("foo.com.", sn).String() != "10.0.0.0/8" {
+		t.Errorf("unexpected subnet: %s", e.matchSubnet("foo.com.", sn))
+	}
+
+	a = e.Query("www.foo.com.", dns.TypeA, sn)
+	if len(a.An) != 1 || a.An[0].(*dns.A).A.String() != "3.3.3.3" {
+		t.Errorf("unexpected answer: %v", a.An)
+	}
+
+	a = e.Query("mail.foo.com.", dns.TypeA, sn)
+	if a.Rcode != dns.RcodeNameError || len(a.Ns) != 1 {
+		t.Errorf("unexpected answer: %s %v", dns.RcodeToString[a.Rcode], a.Ns)
+	}
+
+	a = e.Query("bar.com.", dns.TypeA, sn)
+	if a.Rcode != dns.RcodeRefused {
+		t.Errorf("unexpected rcode: %s", dns.RcodeToString[a.Rcode])
+	}
+}
+
+func TestEtcdRead(t *testing.T) {
+	kvs := map[string]string{
+		"/com/foo/soa":           " 60 SOA ns.foo.com. root.foo.com. 1 3600 600 86400 60",
+		"/com/foo/@10.0.0.0.8/1": " 30 A 2.2.2.2",
+		"/com/foo/zz":            " 30 A 1.1.1.1",
+		"/com/foo/a/b/1":         " 30 A 3.3.3.3",
+	}
+	// more names below than a page
+	for i := 0; i < etcdPage*2; i++ {
+		kvs[fmt.Sprintf("/com/foo/%d/1", i)] = " 30 A 4.4.4.4"
+		kvs[fmt.Sprintf("/com/foo/%d/2", i)] = " 30 A 4.4.4.5"
+	}
+	e := testEtcd(t, kvs)
+
+	item := e.entry(e.dir([]string{"foo", "com"}))
+	if len(item.kvs) != 3 || !item.exists {
+		t.Errorf("unexpected keys of apex: %v", item.kvs)
+	}
+
+	// names below only
+	item = e.entry(e.dir([]string{"a", "foo", "com"}))
+	if item.kvs != nil || !item.exists {
+		t.Errorf("unexpected keys of empty name: %v", item.kvs)
+	}
+	if a := e.Query("a.foo.com.", dns.TypeA, net.IPNet{}); a.Rcode != dns.RcodeSuccess || len(a.An) != 0 {
+		t.Errorf("unexpected answer: %s %v", dns.RcodeToString[a.Rcode], a.An)
+	}
+}
+
+func TestEtcdMigrateNode(t *testing.T) {
+	root := &v2.Node{Key: "/", Dir: true, Nodes: v2.Nodes{
+		{Key: "/com", Dir: true, Nodes: v2.Nodes{
+			{Key: "/com/foo", Dir: true, Nodes: v2.Nodes{
+				{Key: "/com/foo/21", Value: " 30 A 1.1.1.1"},
+				{Key: "/com/foo/@10.0.0.0.8", Dir: true, Nodes: v2.Nodes{
+					{Key: "/com/foo/@10.0.0.0.8/22", Value: " 30 A 2.2.2.2"},
+				}},
+			}},
+		}},
+	}}
+
+	kvs := make(map[string]string)
+	n, err := etcdMigrateNode(root, func(key, value string) error {
+		kvs[key] = value
+		return nil
+	})
+	if err != nil || n != 2 {
+		t.Fatalf("unexpected result: %d, %v", n, err)
+	}
+	if kvs["/com/foo/21"] != " 30 A 1.1.1.1" || kvs["/com/foo/@10.0.0.0.8/22"] != " 30 A 2.2.2.2" {
+		t.Errorf("unexpected keys: %v", kvs)
+	}
+
+	_, err = etcdMigrateNode(root, func(key, value string) error {
+		return fmt.Errorf("failed")
+	})
+	if err == nil {
+		t.Errorf("error not returned")
+	}
+}
+
+func TestEtcdWatch(t *testing.T) {
+	e := testEtcd(t, map[string]string{
+		"/com/foo/1": "foo.com. 60 IN SOA ns.foo.com. root.foo.com. 1 3600 600 86400 60",
+		"/com/foo/2": " 30 A 1.1.1.1",
+	})
+
+	names := make(chan string, 16)
+	e.Notify(func(name string) {
+		select {
+		case names <- name:
+		default:
+		}
+	})
+
+	sn := net.IPNet{IP: net.IPv4(10, 1, 1, 1), Mask: net.CIDRMask(32, 32)}
+	if a := e.Query("www.foo.com.", dns.TypeA, sn); a.Rcode != dns.RcodeNameError {
+		t.Fatalf("unexpected rcode: %s", dns.RcodeToString[a.Rcode])
+	}
+
+	testEtcdChange(t, e, names)
+}
+
+// change keys of www.foo.com. and check answers after notified
+func testEtcdChange(t *testing.T, e *etcd, names chan string) {
+	sn := net.IPNet{IP: net.IPv4(10, 1, 1, 1), Mask: net.CIDRMask(32, 32)}
+	for _, v := range []struct {
+		key, value string
+	}{
+		{"/com/foo/www/@10.0.0.0.8/1", " 30 A 2.2.2.2"},
+		{"/com/foo/www/@10.0.0.0.8/1", ""},
+	} {
+		testEtcdPut(t, e.client, map[string]string{v.key: v.value})
+
+		// events of the keys put before may come first
+		timeout := time.After(5 * time.Second)
+		for name := ""; name != "www.foo.com."; {
+			select {
+			case name = <-names:
+			case <-timeout:
+				t.Fatalf("change not notified: %s", v.key)
+			}
+		}
+
+		a := e.Query("www.foo.com.", dns.TypeA, sn)
+		if v.value != "" && len(a.An) != 1 || v.value == "" && a.Rcode != dns.RcodeNameError {
+			t.Errorf("not updated: %s %v", dns.RcodeToString[a.Rcode], a.An)
+		}
+	}
+}
+
+func TestEtcdMirror(t *testing.T) {
+	machines := testEtcdServer(t)
+	o := testEtcdOptions(machines)
+	cli := testEtcdSource(t, o).client
+	testEtcdPut(t, cli, map[string]string{
+		"/com/foo/1":             "foo.com. 60 IN SOA ns.foo.com. root.foo.com. 1 3600 600 86400 60",
+		"/com/foo/@10.0.0.0.8/2": " 30 A 1.1.1.1",
+	})
+
+	snapshot := filepath.Join(t.TempDir(), "mirror")
+	o["mirror"] = "true"
+	o["mirror.snapshot"] = snapshot
+	e := testEtcdSource(t, o)
+
+	names := make(chan string, 16)
+	e.Notify(func(name string) {
+		select {
+		case names <- name:
+		default:
+		}
+	})
+
+	sn := net.IPNet{IP: net.IPv4(10, 1, 1, 1), Mask: net.CIDRMask(32, 32)}
+	if a := e.Query("foo.com.", dns.TypeA, sn); len(a.An) != 1 {
+		t.Fatalf("unexpected answer: %v", a.An)
+	}
+	if a := e.Query("www.foo.com.", dns.TypeA, sn); a.Rcode != dns.RcodeNameError {
+		t.Fatalf("unexpected rcode: %s", dns.RcodeToString[a.Rcode])
+	}
+
+	testEtcdChange(t, e, names)
+	if n := e.mirror.node("www.foo.com."); n != nil {
+		t.Errorf("empty node not removed")
+	}
+
+	// taken over by a source reloaded while etcd is down
+	r := &etcd{machines: e.machines, prefix: e.prefix, mirror: &mirror{root: newMirrorNode()}}
+	if !r.mirrorTakeOver() || r.mirror.node("foo.com.") == nil {
+		t.Errorf("mirror not taken over")
+	}
+
+	// served from the snapshot if etcd is down
+	e.Close()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	l.Close()
+	o["machines"] = l.Addr().String()
+	o["timeout"] = "100ms"
+	e = testEtcdSource(t, o)
+	if a := e.Query("foo.com.", dns.TypeA, sn); len(a.An) != 1 {
+		t.Errorf("not restored from snapshot: %v", a.An)
+	}
+}
+
+func TestEtcdStale(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	l.Close()
+	o := testEtcdOptions(l.Addr().String())
+	o["timeout"] = "100ms"
+	e := testEtcdSource(t, o)
+
+	// expired keys are served if etcd is unreachable
+	dir := e.dir([]string{"foo", "com"})
+	kvs := []*mvccpb.KeyValue{{Key: []byte(dir + "1"), Value: []byte(" 30 A 1.1.1.1")}}
+	e.cache.Add(dir, &entry{kvs: kvs, expire: time.Now().Add(-time.Second)})
+	if item := e.entry(dir); len(item.kvs) != 1 {
+		t.Errorf("stale keys not served: %v", item.kvs)
+	}
+
+	// failed reads are not cached
+	dir = e.dir([]string{"bar", "com"})
+	if item := e.entry(dir); item.kvs != nil {
+		t.Errorf("unexpected keys: %v", item.kvs)
+	}
+	if _, ok := e.cache.Get(dir); ok {
+		t.Errorf("failed read cached")
+	}
+}
+
+func TestEtcdKeyName(t *testing.T) {
+	e := &etcd{prefix: "/dns"}
+	for key, name := range map[string]string{
+		"/dns/com/foo/1":                 "foo.com.",
+		"/dns/com/foo/www/@10.0.0.0.8/1": "www.foo.com.",
+		"/dns/com/Foo/*/1":               "*.foo.com.",
+		"/dns/1":                         ".",
+	} {
+		if v := e.keyName(key); v != name {
+			t.Errorf("unexpected name of %s: %s", key, v)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+// select records by location of clients in MaxMind databases
+package source
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/oschwald/maxminddb-golang"
+
+	"go.papla.net/goutil/log"
+)
+
+// interval to check if database files are changed
+const geoCheckInterval = 10 * time.Second
+
+// kinds of geo tags, from the most specific
+var geoKinds = []string{"asn", "country", "continent"}
+
+type geoFile struct {
+	path   string
+	mtime  time.Time
+	reader *maxminddb.Reader
+}
+
+// geoDB looks up clients in database files, such as GeoLite2-Country
+// and GeoLite2-ASN. Files are reloaded if changed.
+type geoDB struct {
+	files []*geoFile
+	check time.Time
+	sync.RWMutex
+}
+
+// fields used in a database record
+type geoRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	Continent struct {
+		Code string `maxminddb:"code"`
+	} `maxminddb:"continent"`
+	ASN uint `maxminddb:"autonomous_system_number"`
+}
+
+// newGeoDB opens database files in a comma split list, nil if empty.
+func newGeoDB(paths string) (*geoDB, error) {
+	if strings.TrimSpace(paths) == "" {
+		return nil, nil
+	}
+
+	g := &geoDB{check: time.Now()}
+	for _, path := range commaSplit(paths) {
+		f := &geoFile{path: path}
+		if err := f.load(); err != nil {
+			return nil, err
+		}
+		g.files = append(g.files, f)
+	}
+	return g, nil
+}
+
+// read the whole file instead of mmap, so the old reader can be
+// dropped while still in use.
+func (f *geoFile) load() error {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+
+	b, err := os.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+
+	r, err := maxminddb.FromBytes(b)
+	if err != nil {
+		return makeErr("cannot open geo database %s: %s", f.path, err)
+	}
+
+	f.reader = r
+	f.mtime = info.ModTime()
+	return nil
+}
+
+func (g *geoDB) reload() {
+	g.Lock()
+	defer g.Unlock()
+
+	if time.Since(g.check) < geoCheckInterval {
+		return
+	}
+	g.check = time.Now()
+
+	for i, f := range g.files {
+		info, err := os.Stat(f.path)
+		if err != nil || info.ModTime().Equal(f.mtime) {
+			continue
+		}
+
+		nf := &geoFile{path: f.path}
+		if err := nf.load(); err != nil {
+			log.Warnf("cannot reload geo database: %s", err)
+			continue
+		}
+		g.files[i] = nf
+		log.Infof("geo database reloaded: %s", f.path)
+	}
+}
+
+// lookup tags of ip in all the files, from the most specific. A nil
+// geoDB finds nothing.
+func (g *geoDB) lookup(ip net.IP) []string {
+	if g == nil {
+		return nil
+	}
+
+	g.RLock()
+	check := time.Since(g.check) >= geoCheckInterval
+	g.RUnlock()
+	if check {
+		g.reload()
+	}
+
+	r := &geoRecord{}
+	g.RLock()
+	for _, f := range g.files {
+		if err := f.reader.Lookup(ip, r); err != nil {
+			log.Debugf("cannot lookup %s in %s: %s", ip, f.path, err)
+		}
+	}
+	g.RUnlock()
+
+	var tags []string
+	if r.ASN != 0 {
+		tags = append(tags, "asn:"+strconv.FormatUint(uint64(r.ASN), 10))
+	}
+	if r.Country.ISOCode != "" {
+		tags = append(tags, "country:"+strings.ToLower(r.Country.ISOCode))
+	}
+	if r.Continent.Code != "" {
+		tags = append(tags, "continent:"+strings.ToLower(r.Continent.Code))
+	}
+	return tags
+}
+
+// parse geo tags in annotation, as country:cn,continent:as,asn:4134
+func parseGeoTags(s string) ([]string, error) {
+	var tags []string
+	for _, v := range strings.Split(strings.ToLower(s), ",") {
+		i := strings.Index(v, ":")
+		if i == -1 || i == len(v)-1 {
+			return nil, makeErr("invalid geo tag: %s", v)
+		}
+
+		valid := false
+		for _, k := range geoKinds {
+			valid = valid || v[:i] == k
+		}
+		if !valid {
+			return nil, makeErr("invalid geo tag: %s", v)
+		}
+		tags = append(tags, v)
+	}
+	return tags, nil
+}
+
+// select records tagged by the most specific tag of the client, or
+// the ones without tags. All the records are returned if none of
+// them is untagged.
+func geoFilter(rrs []dns.RR, weights []int, tags [][]string, loc []string) ([]dns.RR, []int) {
+	match := func(f func(t []string) bool) ([]dns.RR, []int) {
+		var (
+			r []dns.RR
+			w []int
+		)
+		for i := range rrs {
+			if f(tags[i]) {
+				r = append(r, rrs[i])
+				w = append(w, weights[i])
+			}
+		}
+		return r, w
+	}
+
+	for _, l := range loc {
+		r, w := match(func(t []string) bool {
+			for _, v := range t {
+				if v == l {
+					return true
+				}
+			}
+			return false
+		})
+		if r != nil {
+			return r, w
+		}
+	}
+
+	if r, w := match(func(t []string) bool { return t == nil }); r != nil {
+		return r, w
+	}
+	return rrs, weights
+}
@@ -0,0 +1,92 @@
+package source
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestGeoSelect(t *testing.T) {
+	_, all, _ := net.ParseCIDR("0.0.0.0/0")
+	s := NewSrecords()
+	for _, v := range []struct {
+		rr, comment string
+	}{
+		{"foo.com. 60 IN A 10.0.0.1", ""},
+		{"foo.com. 60 IN A 10.0.0.2", "; geo=country:CN,country:hk"},
+		{"foo.com. 60 IN A 10.0.0.3", "; geo=continent:as"},
+		{"foo.com. 60 IN A 10.0.0.4", "; geo=asn:4134"},
+		{"foo.com. 60 IN AAAA ::1", "; geo=continent:eu"},
+	} {
+		rr, _ := dns.NewRR(v.rr)
+		if err := s.AddComment(rr, all, v.comment); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	client := net.IPNet{IP: net.IPv4(10, 1, 1, 1), Mask: net.CIDRMask(32, 32)}
+	for _, c := range []struct {
+		loc    []string
+		expect string
+	}{
+		{[]string{"asn:4134", "country:cn", "continent:as"}, "10.0.0.4"},
+		{[]string{"asn:1", "country:cn", "continent:as"}, "10.0.0.2"},
+		{[]string{"country:jp", "continent:as"}, "10.0.0.3"},
+		{[]string{"country:de", "continent:eu"}, "10.0.0.1"},
+		{nil, "10.0.0.1"},
+	} {
+		rr := s.GetGeo(dns.TypeA, client, func() []string { return c.loc })
+		if len(rr) != 1 || rr[0].(*dns.A).A.String() != c.expect {
+			t.Errorf("%v: got %v, expect %s", c.loc, rr, c.expect)
+		}
+	}
+
+	// all records if none untagged
+	if rr := s.GetGeo(dns.TypeAAAA, client, func() []string { return []string{"continent:as"} }); len(rr) != 1 {
+		t.Errorf("no fallback: %v", rr)
+	}
+
+	// location is not looked up for untagged records
+	rr, _ := dns.NewRR("foo.com. 60 IN MX 10 mail.foo.com.")
+	s.Add(rr, all)
+	if rr := s.GetGeo(dns.TypeMX, client, func() []string {
+		t.Errorf("location looked up for untagged records")
+		return nil
+	}); len(rr) != 1 {
+		t.Errorf("unexpected records: %v", rr)
+	}
+
+	if s.Selection(dns.TypeA, client) != "geo" {
+		t.Errorf("wrong selection: %s", s.Selection(dns.TypeA, client))
+	}
+
+	for _, c := range []string{"; geo=city:beijing", "; geo=country:", "; geo=cn"} {
+		if _, err := parseAnnotation(c); err == nil {
+			t.Errorf("should fail: %s", c)
+		}
+	}
+}
+
+func TestGeoDB(t *testing.T) {
+	if g, err := newGeoDB(""); g != nil || err != nil {
+		t.Errorf("should be disabled: %v %v", g, err)
+	}
+
+	var g *geoDB
+	if tags := g.lookup(net.IPv4(10, 1, 1, 1)); tags != nil {
+		t.Errorf("nil geodb finds: %v", tags)
+	}
+
+	path := filepath.Join(t.TempDir(), "bad.mmdb")
+	if err := os.WriteFile(path, []byte("not a database"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{path, path + ".missing"} {
+		if _, err := newGeoDB(p); err == nil {
+			t.Errorf("should fail: %s", p)
+		}
+	}
+}
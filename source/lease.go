@@ -0,0 +1,134 @@
+// register records in etcd attached to leases
+package source
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	client "go.etcd.io/etcd/client/v3"
+
+	"go.papla.net/goutil/log"
+)
+
+// Registration is a record kept in etcd by a lease, which is removed
+// when the lease is not renewed in its ttl, such as the process
+// registering it dies.
+type Registration struct {
+	// name and the record of it in zone file syntax without the owner,
+	// such as "60 A 10.0.0.1".
+	Name   string
+	Record string
+	// for clients in the subnet, or all if nil
+	Subnet *net.IPNet
+	// seconds of the lease, ttl of the record is limited to it
+	TTL int64
+}
+
+// value and key of the record, with the id appended to the key
+func (r *Registration) parse(e *etcd) (string, string, error) {
+	name := strings.ToLower(dns.Fqdn(r.Name))
+	if _, ok := dns.IsDomainName(name); !ok {
+		return "", "", makeErr("invalid name: %s", r.Name)
+	}
+	if r.TTL < 1 {
+		return "", "", makeErr("invalid lease ttl: %d", r.TTL)
+	}
+
+	rr, comment, err := parseRR(name + " " + r.Record)
+	if err != nil || rr == nil {
+		return "", "", makeErr("invalid record: %s", r.Record)
+	}
+
+	if int64(rr.Header().Ttl) > r.TTL {
+		rr.Header().Ttl = uint32(r.TTL)
+	}
+	value := rr.String()
+	if comment != "" {
+		value += " " + comment
+	}
+
+	key := e.dir(dns.SplitDomainName(name))
+	if r.Subnet != nil {
+		key += "@" + subnetName(r.Subnet) + "/"
+	}
+	return value, key, nil
+}
+
+// EtcdRegister keeps the record of r in etcd in background until ctx
+// is done, then removes it and closes the channel returned. The etcd
+// cluster is set by options of the etcd source. The record is put
+// again if its lease is lost, such as etcd is unreachable longer than
+// the ttl.
+func EtcdRegister(ctx context.Context, o map[string]string, r *Registration) (<-chan struct{}, error) {
+	e := &etcd{prefix: strings.TrimSuffix(o["prefix"], "/")}
+	value, dir, err := r.parse(e)
+	if err != nil {
+		return nil, err
+	}
+
+	cli, err := newEtcdClient(o)
+	if err != nil {
+		return nil, err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer cli.Close()
+		for ctx.Err() == nil {
+			if err := e.register(ctx, cli, dir, value, r.TTL); err != nil {
+				log.Warnf("%s cannot register %s: %s", e, r.Name, err)
+				select {
+				case <-ctx.Done():
+				case <-time.After(time.Second):
+				}
+			}
+		}
+	}()
+	return done, nil
+}
+
+// put the record with a new lease and renew it until ctx is done or
+// the lease is lost. The lease, and so the record, is revoked at the
+// end.
+func (e *etcd) register(ctx context.Context, cli *client.Client, dir, value string, ttl int64) error {
+	tctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	lease, err := cli.Grant(tctx, ttl)
+	cancel()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		// ctx may be done already
+		tctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		cli.Revoke(tctx, lease.ID)
+		cancel()
+	}()
+
+	key := fmt.Sprintf("%s%x", dir, lease.ID)
+	tctx, cancel = context.WithTimeout(ctx, 5*time.Second)
+	_, err = cli.Put(tctx, key, value, client.WithLease(lease.ID))
+	cancel()
+	if err != nil {
+		return err
+	}
+
+	ch, err := cli.KeepAlive(ctx, lease.ID)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("%s %s registered: %s", e, key, value)
+	for range ch {
+	}
+	if ctx.Err() != nil {
+		log.Infof("%s %s unregistered", e, key)
+		return nil
+	}
+	return makeErr("lease of %s lost", key)
+}
@@ -0,0 +1,79 @@
+package source
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestRegistrationParse(t *testing.T) {
+	_, sub, _ := net.ParseCIDR("10.0.0.0/8")
+	r := &Registration{Name: "WWW.foo.com", Record: "60 A 10.0.0.1 ; weight=2", Subnet: sub, TTL: 10}
+	value, dir, err := r.parse(&etcd{prefix: "/dns"})
+	if err != nil {
+		t.Fatalf("cannot parse: %s", err)
+	}
+	if value != "www.foo.com.\t10\tIN\tA\t10.0.0.1 ; weight=2" {
+		t.Errorf("unexpected value: %s", value)
+	}
+	if dir != "/dns/com/foo/www/@10.0.0.0.8/" {
+		t.Errorf("unexpected key: %s", dir)
+	}
+
+	for _, r := range []*Registration{
+		{Name: "foo.com.", Record: "not a record", TTL: 10},
+		{Name: "foo.com.", Record: "60 A 10.0.0.1", TTL: 0},
+	} {
+		if _, _, err := r.parse(&etcd{}); err == nil {
+			t.Errorf("invalid registration parsed: %v", r)
+		}
+	}
+}
+
+func TestEtcdRegister(t *testing.T) {
+	e := testEtcd(t, map[string]string{
+		"/com/foo/1": "foo.com. 60 IN SOA ns.foo.com. root.foo.com. 1 3600 600 86400 60",
+	})
+
+	names := make(chan string, 16)
+	e.Notify(func(name string) {
+		select {
+		case names <- name:
+		default:
+		}
+	})
+	wait := func() {
+		timeout := time.After(5 * time.Second)
+		for name := ""; name != "www.foo.com."; {
+			select {
+			case name = <-names:
+			case <-timeout:
+				t.Fatalf("change not notified")
+			}
+		}
+	}
+
+	o := testEtcdOptions(e.machines[0])
+	ctx, cancel := context.WithCancel(context.Background())
+	removed, err := EtcdRegister(ctx, o, &Registration{Name: "www.foo.com.", Record: "60 A 10.0.0.1", TTL: 5})
+	if err != nil {
+		t.Fatalf("cannot register: %s", err)
+	}
+
+	sn := net.IPNet{IP: net.IPv4(10, 1, 1, 1), Mask: net.CIDRMask(32, 32)}
+	wait()
+	a := e.Query("www.foo.com.", dns.TypeA, sn)
+	if len(a.An) != 1 || a.An[0].Header().Ttl != 5 {
+		t.Errorf("unexpected answer: %v", a.An)
+	}
+
+	cancel()
+	<-removed
+	wait()
+	if a := e.Query("www.foo.com.", dns.TypeA, sn); a.Rcode != dns.RcodeNameError {
+		t.Errorf("record not removed: %v", a.An)
+	}
+}
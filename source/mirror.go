@@ -0,0 +1,378 @@
+// mirror all the records of etcd in memory
+package source
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	client "go.etcd.io/etcd/client/v3"
+
+	"go.papla.net/goutil/log"
+)
+
+// a name in the mirror, like node of plain, with the keys of its
+// records to build them again on changes.
+type mirrorNode struct {
+	records *Srecords
+	kvs     map[string]*mvccpb.KeyValue
+	sub     map[string]*mirrorNode
+}
+
+// mirror is a tree of all the keys under the prefix, kept in sync by
+// watching, so queries are answered without reading etcd. The last
+// tree loaded is served when etcd is unreachable.
+type mirror struct {
+	root *mirrorNode
+	// revision of the tree
+	rev int64
+	sync.RWMutex
+}
+
+// record of a key in snapshot file, one per line in json.
+type mirrorRecord struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+func newMirrorNode() *mirrorNode {
+	return &mirrorNode{
+		records: NewSrecords(),
+		kvs:     make(map[string]*mvccpb.KeyValue),
+		sub:     make(map[string]*mirrorNode),
+	}
+}
+
+// node of a name, nil if not exist
+func (m *mirror) node(qname string) *mirrorNode {
+	labels := dns.SplitDomainName(strings.ToLower(qname))
+
+	m.RLock()
+	defer m.RUnlock()
+	ptr := m.root
+	for i := len(labels) - 1; i >= 0 && ptr != nil; i-- {
+		ptr = ptr.sub[labels[i]]
+	}
+	return ptr
+}
+
+func (m *mirror) findNode(qname string) int {
+	labels := dns.SplitDomainName(strings.ToLower(qname))
+
+	m.RLock()
+	defer m.RUnlock()
+	ptr := m.root
+	for i := len(labels) - 1; i >= 0; i-- {
+		sn := ptr.sub[labels[i]]
+		if sn == nil {
+			return i + 1
+		}
+		ptr = sn
+	}
+	return 0
+}
+
+func (m *mirror) records(qname string) *Srecords {
+	n := m.node(qname)
+	if n == nil {
+		return NewSrecords()
+	}
+
+	m.RLock()
+	defer m.RUnlock()
+	return n.records
+}
+
+// load all the keys under the prefix to a new tree.
+func (e *etcd) mirrorLoad(ctx context.Context, cli *client.Client) error {
+	ctx, cancel := context.WithTimeout(ctx, e.timeout)
+	r, err := cli.Get(ctx, e.prefix+"/", client.WithPrefix())
+	cancel()
+	if err != nil {
+		return err
+	}
+
+	root := e.mirrorTree(r.Kvs)
+	warnZoneless(e, root)
+
+	m := e.mirror
+	m.Lock()
+	m.root = root
+	m.rev = r.Header.Revision
+	m.Unlock()
+
+	log.Infof("%s %d keys mirrored at revision %d", e, len(r.Kvs), r.Header.Revision)
+	if e.snapshot != "" {
+		if err := e.mirrorDump(e.snapshot); err != nil {
+			log.Warnf("%s cannot save mirror snapshot: %s", e, err)
+		}
+	}
+	return nil
+}
+
+// build a tree of keys
+func (e *etcd) mirrorTree(kvs []*mvccpb.KeyValue) *mirrorNode {
+	root := newMirrorNode()
+	names := make(map[*mirrorNode]string)
+	for _, kv := range kvs {
+		name := e.keyName(string(kv.Key))
+		n := e.mirrorPut(root, name, kv)
+		names[n] = name
+	}
+	for n, name := range names {
+		e.mirrorBuild(n, name)
+	}
+	return root
+}
+
+func (n *mirrorNode) nodeRecords() *Srecords {
+	return n.records
+}
+
+func (n *mirrorNode) eachSub(f func(label string, sub nameTree)) {
+	for l, sn := range n.sub {
+		f(l, sn)
+	}
+}
+
+// add a key to the tree, returns the node of its name, whose records
+// are built later.
+func (e *etcd) mirrorPut(root *mirrorNode, name string, kv *mvccpb.KeyValue) *mirrorNode {
+	labels := dns.SplitDomainName(name)
+	ptr := root
+	for i := len(labels) - 1; i >= 0; i-- {
+		sn := ptr.sub[labels[i]]
+		if sn == nil {
+			sn = newMirrorNode()
+			ptr.sub[labels[i]] = sn
+		}
+		ptr = sn
+	}
+	ptr.kvs[string(kv.Key)] = kv
+	return ptr
+}
+
+// build records of a node from its keys, in the order of keys as
+// read from etcd.
+func (e *etcd) mirrorBuild(n *mirrorNode, name string) {
+	kvs := make([]*mvccpb.KeyValue, 0, len(n.kvs))
+	for _, kv := range n.kvs {
+		kvs = append(kvs, kv)
+	}
+	sort.Slice(kvs, func(i, j int) bool {
+		return string(kvs[i].Key) < string(kvs[j].Key)
+	})
+
+	s := NewSrecords()
+	e.addRecords(s, name, e.dir(dns.SplitDomainName(name)), kvs)
+	n.records = s
+}
+
+// apply an event of watch to the tree
+func (e *etcd) mirrorApply(ev *client.Event) {
+	m := e.mirror
+	key := string(ev.Kv.Key)
+	name := e.keyName(key)
+	labels := dns.SplitDomainName(name)
+
+	m.Lock()
+	defer m.Unlock()
+
+	if ev.Type == mvccpb.PUT {
+		e.mirrorBuild(e.mirrorPut(m.root, name, ev.Kv), name)
+		return
+	}
+
+	// remove the key, and the nodes left empty
+	path := []*mirrorNode{m.root}
+	for i := len(labels) - 1; i >= 0; i-- {
+		sn := path[len(path)-1].sub[labels[i]]
+		if sn == nil {
+			return
+		}
+		path = append(path, sn)
+	}
+
+	n := path[len(path)-1]
+	delete(n.kvs, key)
+	e.mirrorBuild(n, name)
+	for i := len(path) - 1; i > 0; i-- {
+		if len(path[i].kvs) != 0 || len(path[i].sub) != 0 {
+			break
+		}
+		delete(path[i-1].sub, labels[len(labels)-i])
+	}
+}
+
+// keep the tree in sync by watching from its revision. The tree is
+// loaded again if the watch stops, such as the revision is compacted
+// or the cluster is unreachable, while the old tree is still served.
+func (e *etcd) mirrorSync(ctx context.Context, cli *client.Client) {
+	m := e.mirror
+	for ctx.Err() == nil {
+		m.RLock()
+		rev := m.rev
+		m.RUnlock()
+
+		if rev == 0 {
+			if err := e.mirrorLoad(ctx, cli); err != nil {
+				log.Warnf("%s cannot load mirror, serve the last one: %s", e, err)
+				select {
+				case <-ctx.Done():
+				case <-time.After(time.Second):
+				}
+			} else {
+				e.invalidate(".")
+			}
+			continue
+		}
+
+		opts := []client.OpOption{client.WithPrefix(), client.WithRev(rev + 1)}
+		for r := range cli.Watch(client.WithRequireLeader(ctx), e.prefix+"/", opts...) {
+			if err := r.Err(); err != nil {
+				log.Warnf("%s watch error: %s", e, err)
+				continue
+			}
+
+			for _, ev := range r.Events {
+				e.mirrorApply(ev)
+			}
+			m.Lock()
+			m.rev = r.Header.Revision
+			m.Unlock()
+
+			for _, ev := range r.Events {
+				e.invalidate(e.keyName(string(ev.Kv.Key)))
+			}
+		}
+
+		if ctx.Err() == nil {
+			log.Warnf("%s watch stopped, load mirror again", e)
+			m.Lock()
+			m.rev = 0
+			m.Unlock()
+		}
+	}
+}
+
+// all the keys in the tree
+func (m *mirror) keys() []*mvccpb.KeyValue {
+	var (
+		kvs  []*mvccpb.KeyValue
+		walk func(n *mirrorNode)
+	)
+	walk = func(n *mirrorNode) {
+		for _, kv := range n.kvs {
+			kvs = append(kvs, kv)
+		}
+		for _, sn := range n.sub {
+			walk(sn)
+		}
+	}
+
+	m.RLock()
+	walk(m.root)
+	m.RUnlock()
+	return kvs
+}
+
+// mirrors in use by cluster and prefix. A source made by reloading
+// takes over the tree of the last one if etcd is unreachable, and
+// only the last one saves the snapshot.
+var mirrors = struct {
+	sync.Mutex
+	m map[string]*mirror
+}{m: make(map[string]*mirror)}
+
+func (e *etcd) mirrorKey() string {
+	return strings.Join(e.machines, ",") + e.prefix
+}
+
+// take over the tree of the last mirror with revision 0, so it is
+// loaded from etcd again once reachable. The tree is copied as the
+// last one is still in sync until closed.
+func (e *etcd) mirrorTakeOver() bool {
+	mirrors.Lock()
+	last := mirrors.m[e.mirrorKey()]
+	mirrors.Unlock()
+	if last == nil {
+		return false
+	}
+
+	root := e.mirrorTree(last.keys())
+	e.mirror.Lock()
+	e.mirror.root = root
+	e.mirror.rev = 0
+	e.mirror.Unlock()
+
+	log.Infof("%s mirror taken over from the last source", e)
+	return true
+}
+
+// save all the keys in the tree to a file, which can be read by
+// mirrorRestore when etcd is unreachable at start.
+func (e *etcd) mirrorDump(path string) error {
+	// a unique temp file, in case of other writers
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp)
+
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, kv := range e.mirror.keys() {
+		if err = enc.Encode(&mirrorRecord{Key: string(kv.Key), Value: string(kv.Value)}); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// load the tree from a file written by mirrorDump, with revision 0 so
+// it is loaded from etcd again once reachable.
+func (e *etcd) mirrorRestore(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var kvs []*mvccpb.KeyValue
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for dec.More() {
+		r := &mirrorRecord{}
+		if err := dec.Decode(r); err != nil {
+			return err
+		}
+		kvs = append(kvs, &mvccpb.KeyValue{Key: []byte(r.Key), Value: []byte(r.Value)})
+	}
+	root := e.mirrorTree(kvs)
+
+	e.mirror.Lock()
+	e.mirror.root = root
+	e.mirror.rev = 0
+	e.mirror.Unlock()
+
+	log.Infof("%s mirror restored from %s", e, path)
+	return nil
+}
@@ -15,12 +15,13 @@ import (
 )
 
 func init() {
-	registerSource("plain", &plain{})
+	registerSource("plain", func() Source { return &plain{} })
 }
 
 type plain struct {
 	path string
 	root *node
+	geo  *geoDB
 	init bool
 	sync.RWMutex
 }
@@ -64,17 +65,29 @@ func (p *plain) Reload(o map[string]string) error {
 		return err
 	}
 
+	warnZoneless(p, root)
+
+	geo, err := newGeoDB(o["geo.path"])
+	if err != nil {
+		return err
+	}
+
 	p.Lock()
 	defer p.Unlock()
 
 	p.path = v
 	p.root = root
+	p.geo = geo
 	p.init = true
 	return nil
 }
 
 // implement algorithm described in p24 of rfc1034.
 func (p *plain) Query(qname string, qtype uint16, client net.IPNet) *Answer {
+	return p.Explain(qname, qtype, client, nil)
+}
+
+func (p *plain) Explain(qname string, qtype uint16, client net.IPNet, t *Trace) *Answer {
 	if !p.init {
 		panic(ErrSourceNotInit.Error())
 	}
@@ -82,9 +95,8 @@ func (p *plain) Query(qname string, qtype uint16, client net.IPNet) *Answer {
 	p.RLock()
 	defer p.RUnlock()
 
-	a := &authBase{p}
+	a := &authBase{authExt: p, trace: t}
 	ans := a.query(qname, qtype, client)
-	ans.Auth = true
 	ans.RA = false
 	return ans
 }
@@ -106,6 +118,25 @@ func (p *plain) findNode(qname string) int {
 }
 
 func (p *plain) getRR(qname string, qtype uint16, client net.IPNet) []dns.RR {
+	return p.node(qname).records.GetGeo(qtype, client, func() []string {
+		return p.geo.lookup(client.IP)
+	})
+}
+
+func (p *plain) matchSubnet(qname string, client net.IPNet) *net.IPNet {
+	return p.node(qname).records.Subnet(client)
+}
+
+func (p *plain) hasSubnets(qname string) bool {
+	return p.node(qname).records.bySubnet()
+}
+
+func (p *plain) selection(qname string, qtype uint16, client net.IPNet) string {
+	return p.node(qname).records.Selection(qtype, client)
+}
+
+// node of an existing name
+func (p *plain) node(qname string) *node {
 	qname = strings.ToLower(qname)
 	labels := dns.SplitDomainName(qname)
 	reverseSlice(labels)
@@ -114,13 +145,29 @@ func (p *plain) getRR(qname string, qtype uint16, client net.IPNet) []dns.RR {
 	for i := range labels {
 		ptr = ptr.sub[labels[i]]
 	}
-
-	return ptr.records.Get(qtype, client)
+	return ptr
 }
 
 func plainLoad(path string) (*node, error) {
 	root := plainNewNode()
-	f := func(path string, info os.FileInfo, err error) error {
+	if err := plainWalk(path, func(path, origin string) error {
+		return plainLoadFile(path, origin, root)
+	}); err != nil {
+		return nil, err
+	}
+
+	return root, nil
+}
+
+// call f on every file under path with its origin, hidden files and
+// files to be included by others(*.inc) are ignored.
+//
+// The origin of a file is the name before .zone if named so, or the
+// one in the closest .origin file of its directory and parents, or
+// the root. $ORIGIN in a file still takes effect after it.
+func plainWalk(path string, f func(path, origin string) error) error {
+	origins := make(map[string]string)
+	return filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
 		result := "success"
 		defer func() {
 			log.Debugf("loading file: %s(%s)", path, result)
@@ -131,46 +178,78 @@ func plainLoad(path string) (*node, error) {
 			return err
 		}
 
+		dir := filepath.Dir(path)
+		origin, ok := origins[dir]
+		if !ok {
+			origin = "."
+		}
+
 		if info.IsDir() {
 			result = "ignore"
+			if o, err := plainReadOrigin(filepath.Join(path, ".origin")); err != nil {
+				result = "error"
+				return err
+			} else if o != "" {
+				origin = o
+			}
+			origins[path] = origin
 			return nil
 		}
 
 		// ignore hidden files
-		if strings.HasPrefix(filepath.Base(path), ".") {
+		base := filepath.Base(path)
+		if strings.HasPrefix(base, ".") || strings.HasSuffix(base, ".inc") {
 			result = "ignore"
 			return nil
 		}
 
-		return plainLoadFile(path, root)
+		if strings.HasSuffix(base, ".zone") {
+			origin = strings.ToLower(dns.Fqdn(strings.TrimSuffix(base, ".zone")))
+			if _, ok := dns.IsDomainName(origin); !ok {
+				result = "error"
+				return makeErr("invalid origin in file name: %s", path)
+			}
+		}
+
+		return f(path, origin)
+	})
+}
+
+// read origin from a file, empty if the file does not exist.
+func plainReadOrigin(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
 	}
 
-	if err := filepath.Walk(path, f); err != nil {
-		return nil, err
+	fields := strings.Fields(string(b))
+	if len(fields) != 1 {
+		return "", makeErr("invalid origin in %s", path)
 	}
 
-	return root, nil
+	origin := dns.Fqdn(fields[0])
+	if _, ok := dns.IsDomainName(origin); !ok {
+		return "", makeErr("invalid origin in %s: %s", path, fields[0])
+	}
+	return strings.ToLower(origin), nil
 }
 
-func plainLoadFile(path string, root *node) error {
+func plainLoadFile(path, origin string, root *node) error {
 	f, err := os.Open(path)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
 
-	r := dns.ParseZone(f, ".", "")
+	// file name is needed to resolve relative path in $INCLUDE
+	r := dns.ParseZone(f, origin, path)
 
-	var cidr string
-	base := filepath.Base(path)
-	i := strings.LastIndex(base, ".")
-	if i != -1 {
-		cidr = base[:i] + "/" + base[i+1:]
-	}
-
-	_, sub, err := net.ParseCIDR(cidr)
+	sub, err := subnetOfName(filepath.Base(path))
 	if err != nil {
-		_, sub, _ = net.ParseCIDR("0.0.0.0/0")
+		log.Warnf("%s", err)
 	}
 
 	for t := range r {
@@ -179,12 +258,14 @@ func plainLoadFile(path string, root *node) error {
 		}
 
 		log.Debugf("add to tree: %s [%s]", t.RR, sub)
-		plainAddToNode(root, sub, t.RR)
+		if err := plainAddToNode(root, sub, t.RR, t.Comment); err != nil {
+			return makeErr("%s: %s: %s", path, t.RR, err)
+		}
 	}
 	return nil
 }
 
-func plainAddToNode(n *node, sub *net.IPNet, rr dns.RR) {
+func plainAddToNode(n *node, sub *net.IPNet, rr dns.RR, comment string) error {
 
 	header := rr.Header()
 	labels := dns.SplitDomainName(header.Name)
@@ -204,8 +285,17 @@ func plainAddToNode(n *node, sub *net.IPNet, rr dns.RR) {
 		}
 	}
 
-	ptr.records.Add(rr, sub)
-	//log.Debug("added to node: [%s]", rr)
+	return ptr.records.AddComment(rr, sub, comment)
+}
+
+func (n *node) nodeRecords() *Srecords {
+	return n.records
+}
+
+func (n *node) eachSub(f func(label string, sub nameTree)) {
+	for l, sn := range n.sub {
+		f(l, sn)
+	}
 }
 
 func plainNewNode() *node {
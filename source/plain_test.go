@@ -0,0 +1,72 @@
+package source
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestPlainOrigin(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"foo.com.zone": `
+$TTL 60
+@ IN SOA ns root 1 3600 600 86400 60
+@ IN NS ns
+ns IN A 10.0.0.1
+$INCLUDE www.inc
+`,
+		"www.inc":     "www IN A 10.0.0.2\n",
+		"bar/.origin": "bar.com.\n",
+		"bar/default": `
+@ 60 IN SOA ns.foo.com. root.foo.com. 1 3600 600 86400 60
+www 60 IN A 10.0.0.3
+$ORIGIN baz.com.
+@ 60 IN SOA ns.foo.com. root.foo.com. 1 3600 600 86400 60
+www 60 IN A 10.0.0.4
+`,
+		"bar/10.0.0.0.8": "www 60 IN A 10.0.0.5\n",
+	}
+	for name, content := range files {
+		name = filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	p := &plain{}
+	if err := p.Reload(map[string]string{"path": dir}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, all, _ := net.ParseCIDR("0.0.0.0/0")
+	_, sub, _ := net.ParseCIDR("10.1.0.0/16")
+	for _, c := range []struct {
+		qname  string
+		qtype  uint16
+		client *net.IPNet
+		expect string
+	}{
+		{"foo.com.", dns.TypeNS, all, "foo.com.\t60\tIN\tNS\tns.foo.com."},
+		{"www.foo.com.", dns.TypeA, all, "www.foo.com.\t60\tIN\tA\t10.0.0.2"},
+		{"www.bar.com.", dns.TypeA, all, "www.bar.com.\t60\tIN\tA\t10.0.0.3"},
+		{"www.bar.com.", dns.TypeA, sub, "www.bar.com.\t60\tIN\tA\t10.0.0.5"},
+		{"www.baz.com.", dns.TypeA, all, "www.baz.com.\t60\tIN\tA\t10.0.0.4"},
+	} {
+		a := p.Query(c.qname, c.qtype, *c.client)
+		if len(a.An) != 1 || a.An[0].String() != c.expect {
+			t.Errorf("%s: got %v, expect %s", c.qname, a.An, c.expect)
+		}
+	}
+
+	// included file is not loaded by itself
+	if a := p.Query("www.", dns.TypeA, *all); len(a.An) != 0 {
+		t.Errorf("included file loaded: %v", a.An)
+	}
+}
@@ -10,10 +10,12 @@ import (
 	"github.com/miekg/dns"
 
 	"go.papla.net/goutil/log"
+
+	"go.papla.net/yuanxiao/tap"
 )
 
 func init() {
-	registerSource("relay", &relay{})
+	registerSource("relay", func() Source { return &relay{} })
 }
 
 type result struct {
@@ -39,6 +41,10 @@ func (r *relay) String() string {
 	return "[source.relay]"
 }
 
+func (r *relay) Recursive() bool {
+	return true
+}
+
 func (r *relay) Reload(o map[string]string) error {
 	var (
 		err       error
@@ -120,6 +126,10 @@ func (r *relay) Reload(o map[string]string) error {
 }
 
 func (r *relay) Query(qname string, qtype uint16, client net.IPNet) *Answer {
+	return r.Explain(qname, qtype, client, nil)
+}
+
+func (r *relay) Explain(qname string, qtype uint16, client net.IPNet, t *Trace) *Answer {
 	if !r.init {
 		panic(ErrSourceNotInit.Error())
 	}
@@ -154,8 +164,11 @@ func (r *relay) Query(qname string, qtype uint16, client net.IPNet) *Answer {
 		Auth:  false,
 		RA:    true,
 	}
-	a := relayChoose(results)
-	if a != nil {
+	t.Addf("%s: %d of %d upstreams answered", qname, len(results), upCount)
+	res := relayChoose(results)
+	if res != nil {
+		t.Addf("%s: using answer from %s, filtered: %v", qname, res.upstream.addr, res.filtered)
+		a := res.response
 		ans.An = a.Answer
 		ans.Ns = a.Ns
 		ans.Ex = a.Extra
@@ -183,17 +196,20 @@ func relayResolve(upstream *resolver,
 
 	defer conn.Close()
 
-	conn.SetWriteDeadline(time.Now().Add(timeout))
+	qt := time.Now()
+	conn.SetWriteDeadline(qt.Add(timeout))
 	if err = conn.WriteMsg(m); err != nil {
 		log.Warnf("cannot write to upstream %s", upstream.addr)
 		return
 	}
+	tap.ForwarderQuery(conn.LocalAddr(), conn.RemoteAddr(), m, qt)
 
 	conn.SetReadDeadline(time.Now().Add(timeout))
 	a, err := conn.ReadMsg()
 	if err != nil {
 		return
 	}
+	tap.ForwarderResponse(conn.LocalAddr(), conn.RemoteAddr(), m, a, qt, time.Now())
 
 	if delay == 0 {
 		res.response = a
@@ -215,6 +231,7 @@ func relayResolve(upstream *resolver,
 			if err != nil {
 				return
 			}
+			tap.ForwarderResponse(conn.LocalAddr(), conn.RemoteAddr(), m, a, qt, time.Now())
 			select {
 			case ch <- a:
 			default:
@@ -250,7 +267,7 @@ func relayResolve(upstream *resolver,
 }
 
 // return filtered answer if polluted, else the local one for CDN
-func relayChoose(rs []*result) *dns.Msg {
+func relayChoose(rs []*result) *result {
 	if len(rs) == 0 {
 		return nil
 	}
@@ -268,16 +285,16 @@ func relayChoose(rs []*result) *dns.Msg {
 
 	if filtered != nil {
 		log.Debugf("using filtered answer from %s", filtered.upstream.addr)
-		return filtered.response
+		return filtered
 	}
 
 	if local != nil {
 		log.Debugf("using local answer from %s", local.upstream.addr)
-		return local.response
+		return local
 	}
 
 	log.Debugf("no local answer, use %s", rs[0].upstream.addr)
-	return rs[0].response
+	return rs[0]
 }
 
 func relayClean(answers []*dns.Msg) *dns.Msg {
@@ -295,11 +312,5 @@ func relayClean(answers []*dns.Msg) *dns.Msg {
 			lowerTTL = a
 		}
 	}
-
-	// reduce the affection in case that we've selected a wrong
-	// answer.
-	if lowerTTL != nil && lowerTTL.Answer[0].Header().Ttl > 1800 {
-		lowerTTL.Answer[0].Header().Ttl = 300
-	}
 	return lowerTTL
 }
@@ -0,0 +1,185 @@
+// select records of a RRset by policies in annotations
+package source
+
+import (
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// policies of selection
+const (
+	selectShuffle    = "shuffle"
+	selectRoundRobin = "roundrobin"
+	selectWeighted   = "weighted"
+	selectHash       = "hash"
+)
+
+// annotation of a record, written in its comment as key=value:
+//
+//	www.foo.com. 60 IN A 10.0.0.1 ; select=weighted count=1 weight=80
+//	www.foo.com. 60 IN A 10.1.0.1 ; geo=country:cn,asn:4134
+//
+// select and count apply to the RRset of the record, weight and geo to
+// the record only. Words not in this form are ignored as normal
+// comment.
+type annotation struct {
+	policy string
+	count  int
+	weight int
+	geo    []string
+}
+
+func parseAnnotation(comment string) (*annotation, error) {
+	a := &annotation{weight: 1}
+	for _, v := range strings.Fields(strings.TrimPrefix(strings.TrimSpace(comment), ";")) {
+		i := strings.Index(v, "=")
+		if i == -1 {
+			continue
+		}
+
+		key, value := v[:i], v[i+1:]
+		switch key {
+		case "select":
+			switch value {
+			case selectShuffle, selectRoundRobin, selectWeighted, selectHash:
+				a.policy = value
+			default:
+				return nil, makeErr("invalid select policy: %s", value)
+			}
+		case "count":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return nil, makeErr("invalid count: %s", value)
+			}
+			a.count = n
+		case "weight":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return nil, makeErr("invalid weight: %s", value)
+			}
+			a.weight = n
+		case "geo":
+			tags, err := parseGeoTags(value)
+			if err != nil {
+				return nil, err
+			}
+			a.geo = tags
+		}
+	}
+	return a, nil
+}
+
+// selection policy of a RRset
+type selector struct {
+	policy string
+	// number of records to answer, 0 for all
+	count int
+	// turn of round robin
+	next uint32
+}
+
+// update the selector of a RRset by annotation of one of its records,
+// returns nil if none.
+func (s *selector) update(a *annotation) *selector {
+	if a.policy == "" && a.count == 0 {
+		return s
+	}
+
+	if s == nil {
+		s = &selector{}
+	}
+	if a.policy != "" {
+		s.policy = a.policy
+	}
+	if a.count != 0 {
+		s.count = a.count
+	}
+	return s
+}
+
+// select records from rrs with their weights. turn is used by round
+// robin, client by hash.
+func (s *selector) apply(rrs []dns.RR, weights []int, client string, turn uint32) []dns.RR {
+	if len(rrs) == 0 {
+		return rrs
+	}
+
+	count := s.count
+	if count == 0 || count > len(rrs) {
+		count = len(rrs)
+		if s.policy == selectWeighted || s.policy == selectHash {
+			count = 1
+		}
+	}
+
+	result := make([]dns.RR, 0, len(rrs))
+	switch s.policy {
+	case selectShuffle:
+		result = append(result, rrs...)
+		rand.Shuffle(len(result), func(i, j int) {
+			result[i], result[j] = result[j], result[i]
+		})
+	case selectRoundRobin:
+		i := int(turn % uint32(len(rrs)))
+		result = append(result, rrs[i:]...)
+		result = append(result, rrs[:i]...)
+	case selectWeighted:
+		w := append([]int(nil), weights...)
+		for len(result) < count {
+			total := 0
+			for _, v := range w {
+				total += v
+			}
+			if total == 0 {
+				break
+			}
+
+			n := rand.Intn(total)
+			for i, v := range w {
+				if n < v {
+					result = append(result, rrs[i])
+					w[i] = 0
+					break
+				}
+				n -= v
+			}
+		}
+	case selectHash:
+		// weighted rendezvous hashing, a client keeps its records
+		// while others are added or removed.
+		type score struct {
+			rr dns.RR
+			s  float64
+		}
+		var scores []score
+		for i, rr := range rrs {
+			if weights[i] == 0 {
+				continue
+			}
+			h := fnv.New64a()
+			h.Write([]byte(client))
+			h.Write([]byte(rr.String()))
+			u := (float64(h.Sum64()>>11) + 0.5) / (1 << 53)
+			scores = append(scores, score{rr, float64(weights[i]) / -math.Log(u)})
+		}
+		sort.Slice(scores, func(i, j int) bool {
+			return scores[i].s > scores[j].s
+		})
+		for _, v := range scores {
+			result = append(result, v.rr)
+		}
+	default:
+		result = append(result, rrs...)
+	}
+
+	if len(result) > count {
+		result = result[:count]
+	}
+	return result
+}
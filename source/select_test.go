@@ -0,0 +1,113 @@
+package source
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func testRecords(t *testing.T, comments ...string) *Srecords {
+	_, all, _ := net.ParseCIDR("0.0.0.0/0")
+	s := NewSrecords()
+	for i, c := range comments {
+		rr, _ := dns.NewRR(fmt.Sprintf("foo.com. 60 IN A 10.0.0.%d", i+1))
+		if err := s.AddComment(rr, all, c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return s
+}
+
+func TestParseAnnotation(t *testing.T) {
+	a, err := parseAnnotation("; web server select=weighted count=2 weight=80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.policy != selectWeighted || a.count != 2 || a.weight != 80 {
+		t.Errorf("wrong annotation: %+v", a)
+	}
+
+	for _, c := range []string{"; select=random", "; count=0", "; weight=-1"} {
+		if _, err := parseAnnotation(c); err == nil {
+			t.Errorf("should fail: %s", c)
+		}
+	}
+}
+
+func TestSelectRoundRobin(t *testing.T) {
+	s := testRecords(t, "; select=roundrobin", "", "")
+	client := net.IPNet{IP: net.IPv4(10, 1, 1, 1), Mask: net.CIDRMask(32, 32)}
+
+	for i := 0; i < 6; i++ {
+		rr := s.Get(dns.TypeA, client)
+		if len(rr) != 3 || rr[0].(*dns.A).A.String() != fmt.Sprintf("10.0.0.%d", i%3+1) {
+			t.Errorf("wrong order: %v", rr)
+		}
+	}
+
+	if s.Selection(dns.TypeA, client) != selectRoundRobin || s.Selection(dns.TypeAAAA, client) != "" {
+		t.Errorf("wrong selection")
+	}
+}
+
+func TestSelectWeighted(t *testing.T) {
+	s := testRecords(t, "; select=weighted weight=80", "; weight=20", "; weight=0")
+	client := net.IPNet{IP: net.IPv4(10, 1, 1, 1), Mask: net.CIDRMask(32, 32)}
+
+	n := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		rr := s.Get(dns.TypeA, client)
+		if len(rr) != 1 {
+			t.Fatalf("wrong count: %v", rr)
+		}
+		n[rr[0].(*dns.A).A.String()]++
+	}
+
+	if n["10.0.0.3"] != 0 || n["10.0.0.1"] < 700 || n["10.0.0.1"] > 900 {
+		t.Errorf("wrong distribution: %v", n)
+	}
+}
+
+func TestSelectHash(t *testing.T) {
+	s := testRecords(t, "; select=hash count=2", "", "", "")
+
+	n := map[string]int{}
+	for i := 0; i < 256; i++ {
+		client := net.IPNet{IP: net.IPv4(10, 1, byte(i), 0), Mask: net.CIDRMask(24, 32)}
+		rr := s.Get(dns.TypeA, client)
+		if len(rr) != 2 {
+			t.Fatalf("wrong count: %v", rr)
+		}
+
+		// the same client gets the same records
+		again := s.Get(dns.TypeA, client)
+		if rr[0].String() != again[0].String() || rr[1].String() != again[1].String() {
+			t.Errorf("records changed for %s: %v, %v", &client, rr, again)
+		}
+		n[rr[0].(*dns.A).A.String()]++
+	}
+
+	if len(n) != 4 {
+		t.Errorf("records not spread: %v", n)
+	}
+}
+
+func TestSelectShuffle(t *testing.T) {
+	s := testRecords(t, "; select=shuffle count=2", "", "")
+	client := net.IPNet{IP: net.IPv4(10, 1, 1, 1), Mask: net.CIDRMask(32, 32)}
+
+	n := map[string]int{}
+	for i := 0; i < 100; i++ {
+		rr := s.Get(dns.TypeA, client)
+		if len(rr) != 2 {
+			t.Fatalf("wrong count: %v", rr)
+		}
+		n[rr[0].(*dns.A).A.String()]++
+	}
+
+	if len(n) != 3 {
+		t.Errorf("records not shuffled: %v", n)
+	}
+}
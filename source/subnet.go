@@ -0,0 +1,149 @@
+// index of subnet records, for longest prefix matching
+package source
+
+import (
+	"net"
+	"strconv"
+	"strings"
+)
+
+// a node of binary radix tree, children are indexed by the next bit
+// of address.
+type trieNode struct {
+	child [2]*trieNode
+	r     *srecord
+}
+
+// subnetTrie finds records of the longest prefix in O(prefix length).
+// IPv4 and IPv6 have their own trees, and /0 of either matches all
+// the clients.
+type subnetTrie struct {
+	v4, v6 trieNode
+	all    *srecord
+}
+
+// address bytes of n and its prefix length, nil if not valid
+func subnetKey(n net.IPNet) (net.IP, int) {
+	ones, bits := n.Mask.Size()
+	switch bits {
+	case 8 * net.IPv4len:
+		if ip := n.IP.To4(); ip != nil {
+			return ip, ones
+		}
+	case 8 * net.IPv6len:
+		if ip := n.IP.To16(); ip != nil {
+			return ip, ones
+		}
+	}
+	return nil, 0
+}
+
+func (t *subnetTrie) root(ip net.IP) *trieNode {
+	if len(ip) == net.IPv4len {
+		return &t.v4
+	}
+	return &t.v6
+}
+
+// get records of exactly subnet n, made by f if not found.
+func (t *subnetTrie) get(n *net.IPNet, f func() *srecord) *srecord {
+	ip, ones := subnetKey(*n)
+	if ip == nil || ones == 0 {
+		if t.all == nil {
+			t.all = f()
+		}
+		return t.all
+	}
+
+	node := t.root(ip)
+	for i := 0; i < ones; i++ {
+		b := ip[i/8] >> (7 - uint(i%8)) & 1
+		if node.child[b] == nil {
+			node.child[b] = &trieNode{}
+		}
+		node = node.child[b]
+	}
+
+	if node.r == nil {
+		node.r = f()
+	}
+	return node.r
+}
+
+// match finds records of the smallest subnet contains sn.
+func (t *subnetTrie) match(sn net.IPNet) *srecord {
+	best := t.all
+
+	ip, ones := subnetKey(sn)
+	if ip == nil {
+		return best
+	}
+
+	node := t.root(ip)
+	for i := 0; ; i++ {
+		if node.r != nil {
+			best = node.r
+		}
+		if i == ones {
+			break
+		}
+
+		node = node.child[ip[i/8]>>(7-uint(i%8))&1]
+		if node == nil {
+			break
+		}
+	}
+	return best
+}
+
+// subnet of records named as address.prefixlen, such as 10.0.0.0.8 for
+// 10.0.0.0/8, which is a file name in plain and a directory name in
+// etcd. Records under other names are for all clients. An error is
+// returned if the name looks like a subnet but is not a valid one,
+// with the subnet guessed from it.
+func subnetOfName(name string) (*net.IPNet, error) {
+	_, all, _ := net.ParseCIDR("0.0.0.0/0")
+
+	i := strings.LastIndex(name, ".")
+	if i == -1 {
+		return all, nil
+	}
+
+	ip, sub, err := net.ParseCIDR(name[:i] + "/" + name[i+1:])
+	if err != nil {
+		if strings.Trim(name, "0123456789abcdefABCDEF.:") == "" &&
+			strings.ContainsAny(name[:i], ".:") {
+			return all, makeErr("invalid subnet in name: %s", name)
+		}
+		return all, nil
+	}
+
+	if !ip.Equal(sub.IP) {
+		return sub, makeErr("host bits set in subnet of name: %s", name)
+	}
+	return sub, nil
+}
+
+// parseSubnetName reads a subnet named as by subnetName, unlike
+// subnetOfName an error is returned for any other name.
+func parseSubnetName(name string) (*net.IPNet, error) {
+	i := strings.LastIndex(name, ".")
+	if i == -1 {
+		return nil, makeErr("invalid subnet in name: %s", name)
+	}
+
+	ip, sub, err := net.ParseCIDR(name[:i] + "/" + name[i+1:])
+	if err != nil {
+		return nil, makeErr("invalid subnet in name: %s", name)
+	}
+	if !ip.Equal(sub.IP) {
+		return nil, makeErr("host bits set in subnet of name: %s", name)
+	}
+	return sub, nil
+}
+
+// name of subnet n, which is read by subnetOfName
+func subnetName(n *net.IPNet) string {
+	ones, _ := n.Mask.Size()
+	return n.IP.String() + "." + strconv.Itoa(ones)
+}
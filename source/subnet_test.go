@@ -0,0 +1,91 @@
+package source
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestSubnetMatch(t *testing.T) {
+	s := NewSrecords()
+	for _, v := range []struct {
+		subnet, rr string
+	}{
+		{"0.0.0.0/0", "foo.com. 60 IN A 1.1.1.1"},
+		{"10.0.0.0/8", "foo.com. 60 IN A 2.2.2.2"},
+		{"10.1.0.0/16", "foo.com. 60 IN A 3.3.3.3"},
+		{"10.1.2.3/32", "foo.com. 60 IN A 4.4.4.4"},
+		{"2001:db8::/32", "foo.com. 60 IN A 5.5.5.5"},
+		{"2001:db8:1::/48", "foo.com. 60 IN A 6.6.6.6"},
+	} {
+		_, n, _ := net.ParseCIDR(v.subnet)
+		rr, _ := dns.NewRR(v.rr)
+		s.Add(rr, n)
+	}
+
+	for _, c := range []struct {
+		client, expect string
+	}{
+		{"192.168.0.1/32", "1.1.1.1"},
+		{"10.2.0.1/32", "2.2.2.2"},
+		{"10.1.0.1/32", "3.3.3.3"},
+		{"10.1.2.3/32", "4.4.4.4"},
+		{"10.1.2.0/24", "3.3.3.3"},
+		{"10.0.0.0/7", "1.1.1.1"},
+		{"2001:db8:2::1/128", "5.5.5.5"},
+		{"2001:db8:1::1/128", "6.6.6.6"},
+		{"2001:db8::/31", "1.1.1.1"},
+		{"2001:dead::1/128", "1.1.1.1"},
+	} {
+		ip, n, _ := net.ParseCIDR(c.client)
+		n.IP = ip
+		rr := s.Get(dns.TypeA, *n)
+		if len(rr) != 1 || rr[0].(*dns.A).A.String() != c.expect {
+			t.Errorf("%s: got %v, expect %s", c.client, rr, c.expect)
+		}
+	}
+
+	// records of the same subnet are added together
+	_, n, _ := net.ParseCIDR("10.1.0.0/16")
+	rr, _ := dns.NewRR("foo.com. 60 IN A 3.3.3.4")
+	s.Add(rr, n)
+	client := net.IPNet{IP: net.ParseIP("10.1.0.1").To4(), Mask: net.CIDRMask(32, 32)}
+	if rr := s.Get(dns.TypeA, client); len(rr) != 2 {
+		t.Errorf("records not added together: %v", rr)
+	}
+	if s.Subnet(client).String() != "10.1.0.0/16" {
+		t.Errorf("wrong subnet: %s", s.Subnet(client))
+	}
+}
+
+func benchmarkSrecords(b *testing.B, n int) {
+	s := NewSrecords()
+	rr, _ := dns.NewRR("foo.com. 60 IN A 1.1.1.1")
+	_, all, _ := net.ParseCIDR("0.0.0.0/0")
+	s.Add(rr, all)
+	for i := 0; i < n; i++ {
+		_, v4, _ := net.ParseCIDR(fmt.Sprintf("10.%d.%d.0/24", i/256, i%256))
+		s.Add(rr, v4)
+		_, v6, _ := net.ParseCIDR(fmt.Sprintf("2001:db8:%x::/48", i))
+		s.Add(rr, v6)
+	}
+
+	clients := []net.IPNet{
+		{IP: net.ParseIP("10.0.200.1").To4(), Mask: net.CIDRMask(32, 32)},
+		{IP: net.ParseIP("192.168.0.1").To4(), Mask: net.CIDRMask(32, 32)},
+		{IP: net.ParseIP("2001:db8:10::1"), Mask: net.CIDRMask(128, 128)},
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if s.Get(dns.TypeA, clients[i%len(clients)]) == nil {
+			b.Fatal("no record")
+		}
+	}
+}
+
+func BenchmarkSrecords10(b *testing.B)    { benchmarkSrecords(b, 10) }
+func BenchmarkSrecords1000(b *testing.B)  { benchmarkSrecords(b, 1000) }
+func BenchmarkSrecords10000(b *testing.B) { benchmarkSrecords(b, 10000) }
@@ -0,0 +1,247 @@
+// Package tap emits dnstap messages of client and forwarder queries.
+package tap
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	dnstap "github.com/dnstap/golang-dnstap"
+	"github.com/miekg/dns"
+	"google.golang.org/protobuf/proto"
+
+	"go.papla.net/goutil/log"
+)
+
+var (
+	lock     sync.RWMutex
+	output   dnstap.Output
+	file     *os.File
+	address  string
+	identity []byte
+)
+
+// Setup opens a new output and closes the previous one. The address
+// is in format of unix:/path/to/socket or file:/path/to/file, empty
+// address disables the output. The output is kept if the address is
+// not changed, and files are appended to.
+func Setup(addr, id string) error {
+	if id == "" {
+		id, _ = os.Hostname()
+	}
+
+	lock.Lock()
+	if addr == address {
+		identity = []byte(id)
+		lock.Unlock()
+		return nil
+	}
+	lock.Unlock()
+
+	var (
+		o   dnstap.Output
+		f   *os.File
+		err error
+	)
+
+	switch {
+	case addr == "":
+	case strings.HasPrefix(addr, "unix:"):
+		var a *net.UnixAddr
+		a, err = net.ResolveUnixAddr("unix", addr[len("unix:"):])
+		if err == nil {
+			o, err = dnstap.NewFrameStreamSockOutput(a)
+		}
+	case strings.HasPrefix(addr, "file:"):
+		f, err = os.OpenFile(addr[len("file:"):], os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err == nil {
+			if o, err = dnstap.NewFrameStreamOutput(f); err != nil {
+				f.Close()
+			}
+		}
+	default:
+		return makeErr("invalid dnstap output: %s", addr)
+	}
+	if err != nil {
+		return err
+	}
+
+	if o != nil {
+		go o.RunOutputLoop()
+	}
+
+	lock.Lock()
+	old, oldf := output, file
+	output, file = o, f
+	address = addr
+	identity = []byte(id)
+	lock.Unlock()
+
+	// no one is sending to the old output now
+	if old != nil {
+		old.Close()
+	}
+	if oldf != nil {
+		oldf.Close()
+	}
+	return nil
+}
+
+// Close flushes and closes the output.
+func Close() {
+	Setup("", "")
+}
+
+// Enabled tells whether messages will be emitted.
+func Enabled() bool {
+	lock.RLock()
+	defer lock.RUnlock()
+	return output != nil
+}
+
+// ClientQuery emits a query received from client.
+func ClientQuery(client net.Addr, q *dns.Msg, qt time.Time) {
+	if !Enabled() {
+		return
+	}
+
+	m := newMessage(dnstap.Message_CLIENT_QUERY, client, nil)
+	setQuery(m, q, qt)
+	emit(m)
+}
+
+// ClientResponse emits a response sent to client.
+func ClientResponse(client net.Addr, q, r *dns.Msg, qt, rt time.Time) {
+	if !Enabled() {
+		return
+	}
+
+	m := newMessage(dnstap.Message_CLIENT_RESPONSE, client, nil)
+	setQuery(m, q, qt)
+	setResponse(m, r, rt)
+	emit(m)
+}
+
+// ForwarderQuery emits a query sent to upstream from a local address.
+func ForwarderQuery(local, upstream net.Addr, q *dns.Msg, qt time.Time) {
+	if !Enabled() {
+		return
+	}
+
+	m := newMessage(dnstap.Message_FORWARDER_QUERY, local, upstream)
+	setQuery(m, q, qt)
+	emit(m)
+}
+
+// ForwarderResponse emits a response received from upstream.
+func ForwarderResponse(local, upstream net.Addr, q, r *dns.Msg, qt, rt time.Time) {
+	if !Enabled() {
+		return
+	}
+
+	m := newMessage(dnstap.Message_FORWARDER_RESPONSE, local, upstream)
+	setQuery(m, q, qt)
+	setResponse(m, r, rt)
+	emit(m)
+}
+
+func newMessage(t dnstap.Message_Type, qaddr, raddr net.Addr) *dnstap.Message {
+	m := &dnstap.Message{
+		Type: t.Enum(),
+	}
+
+	var ip net.IP
+	var qport, rport int
+	switch a := qaddr.(type) {
+	case *net.UDPAddr:
+		m.SocketProtocol = dnstap.SocketProtocol_UDP.Enum()
+		ip, qport = a.IP, a.Port
+	case *net.TCPAddr:
+		m.SocketProtocol = dnstap.SocketProtocol_TCP.Enum()
+		ip, qport = a.IP, a.Port
+	default:
+		return m
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		m.SocketFamily = dnstap.SocketFamily_INET.Enum()
+		ip = ip4
+	} else {
+		m.SocketFamily = dnstap.SocketFamily_INET6.Enum()
+	}
+	m.QueryAddress = ip
+	m.QueryPort = proto.Uint32(uint32(qport))
+
+	switch a := raddr.(type) {
+	case *net.UDPAddr:
+		ip, rport = a.IP, a.Port
+	case *net.TCPAddr:
+		ip, rport = a.IP, a.Port
+	default:
+		return m
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	m.ResponseAddress = ip
+	m.ResponsePort = proto.Uint32(uint32(rport))
+	return m
+}
+
+func setQuery(m *dnstap.Message, q *dns.Msg, t time.Time) {
+	m.QueryTimeSec = proto.Uint64(uint64(t.Unix()))
+	m.QueryTimeNsec = proto.Uint32(uint32(t.Nanosecond()))
+	if b, err := q.Pack(); err == nil {
+		m.QueryMessage = b
+	}
+}
+
+func setResponse(m *dnstap.Message, r *dns.Msg, t time.Time) {
+	m.ResponseTimeSec = proto.Uint64(uint64(t.Unix()))
+	m.ResponseTimeNsec = proto.Uint32(uint32(t.Nanosecond()))
+	if b, err := r.Pack(); err == nil {
+		m.ResponseMessage = b
+	}
+}
+
+func emit(m *dnstap.Message) {
+	lock.RLock()
+	defer lock.RUnlock()
+
+	if output == nil {
+		return
+	}
+
+	d := &dnstap.Dnstap{
+		Type:     dnstap.Dnstap_MESSAGE.Enum(),
+		Identity: identity,
+		Message:  m,
+	}
+
+	b, err := proto.Marshal(d)
+	if err != nil {
+		log.Warnf("cannot marshal dnstap message: %s", err)
+		return
+	}
+
+	// never block the query
+	select {
+	case output.GetOutputChannel() <- b:
+	default:
+	}
+}
+
+func makeErr(v ...interface{}) error {
+	var msg string
+	if len(v) == 1 {
+		msg = fmt.Sprintf("%s", v[0])
+	} else {
+		msg = fmt.Sprintf(v[0].(string), v[1:]...)
+	}
+	return errors.New(msg)
+}
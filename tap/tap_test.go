@@ -0,0 +1,65 @@
+package tap
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	dnstap "github.com/dnstap/golang-dnstap"
+	"github.com/miekg/dns"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestFileOutput(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dnstap.fstrm")
+	if err := Setup("file:"+path, "test"); err != nil {
+		t.Fatalf("cannot setup output: %s", err)
+	}
+
+	client := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5353}
+	q := &dns.Msg{}
+	q.SetQuestion("foo.com.", dns.TypeA)
+	r := &dns.Msg{}
+	r.SetReply(q)
+
+	now := time.Now()
+	ClientQuery(client, q, now)
+	// reloaded with the same address
+	if err := Setup("file:"+path, "test"); err != nil {
+		t.Fatalf("cannot setup output again: %s", err)
+	}
+	ClientResponse(client, q, r, now, now)
+	Close()
+
+	in, err := dnstap.NewFrameStreamInputFromFilename(path)
+	if err != nil {
+		t.Fatalf("cannot open output: %s", err)
+	}
+
+	ch := make(chan []byte, 8)
+	go func() {
+		in.ReadInto(ch)
+		close(ch)
+	}()
+
+	var types []dnstap.Message_Type
+	for b := range ch {
+		d := &dnstap.Dnstap{}
+		if err := proto.Unmarshal(b, d); err != nil {
+			t.Fatalf("cannot decode message: %s", err)
+		}
+		if string(d.Identity) != "test" {
+			t.Errorf("identity: %s != test", d.Identity)
+		}
+		if !net.IP(d.Message.QueryAddress).Equal(client.IP) {
+			t.Errorf("query address: %s != %s", net.IP(d.Message.QueryAddress), client.IP)
+		}
+		types = append(types, d.Message.GetType())
+	}
+
+	if len(types) != 2 || types[0] != dnstap.Message_CLIENT_QUERY ||
+		types[1] != dnstap.Message_CLIENT_RESPONSE {
+		t.Errorf("unexpected messages: %v", types)
+	}
+}
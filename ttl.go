@@ -0,0 +1,177 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+
+	"go.papla.net/yuanxiao/source"
+)
+
+// ttl limits for answers, 0 means no limit.
+type ttlPolicy struct {
+	min      uint32
+	max      uint32
+	negative uint32
+}
+
+// server wide limits, which can be overridden by source or zone.
+type ttlPolicies struct {
+	def     ttlPolicy
+	sources map[string]*ttlPolicy
+	zones   map[string]*ttlPolicy
+}
+
+// parse limits from server options. The override is in format of
+// name=min:max:negative, name is either a source name or a zone
+// ending with '.'. Empty fields inherit server limits.
+func newTTLPolicies(min, max, negative int, override string) (*ttlPolicies, error) {
+	if min < 0 || max < 0 || negative < 0 {
+		return nil, makeErr("invalid ttl limit: %d, %d, %d", min, max, negative)
+	}
+
+	p := &ttlPolicies{
+		def: ttlPolicy{
+			min:      uint32(min),
+			max:      uint32(max),
+			negative: uint32(negative),
+		},
+		sources: make(map[string]*ttlPolicy),
+		zones:   make(map[string]*ttlPolicy),
+	}
+
+	if strings.TrimSpace(override) == "" {
+		return p, nil
+	}
+
+	for _, v := range strings.Split(override, ",") {
+		v = strings.TrimSpace(v)
+		i := strings.Index(v, "=")
+		if i == -1 {
+			return nil, makeErr("invalid ttl override: %s", v)
+		}
+
+		name := v[:i]
+		fields := strings.Split(v[i+1:], ":")
+		if name == "" || len(fields) != 3 {
+			return nil, makeErr("invalid ttl override: %s", v)
+		}
+
+		tp := p.def
+		for j, f := range fields {
+			if f == "" {
+				continue
+			}
+
+			n, err := strconv.ParseUint(f, 10, 32)
+			if err != nil {
+				return nil, makeErr("invalid ttl override: %s", v)
+			}
+
+			switch j {
+			case 0:
+				tp.min = uint32(n)
+			case 1:
+				tp.max = uint32(n)
+			case 2:
+				tp.negative = uint32(n)
+			}
+		}
+
+		if dns.IsFqdn(name) {
+			p.zones[strings.ToLower(name)] = &tp
+		} else {
+			p.sources[name] = &tp
+		}
+	}
+
+	return p, nil
+}
+
+// find the policy for a name from a source, zone has higher priority.
+func (p *ttlPolicies) get(qname, source string) *ttlPolicy {
+	labels := dns.SplitDomainName(strings.ToLower(qname))
+	for i := range labels {
+		if tp := p.zones[strings.Join(labels[i:], ".")+"."]; tp != nil {
+			return tp
+		}
+	}
+
+	if tp := p.zones["."]; tp != nil {
+		return tp
+	}
+
+	if tp := p.sources[source]; tp != nil {
+		return tp
+	}
+
+	return &p.def
+}
+
+// apply returns an answer with limited ttl. Records are copied if
+// modified, as they may be shared with the source.
+func (p *ttlPolicies) apply(qname string, a *source.Answer) *source.Answer {
+	tp := p.get(qname, a.Source)
+	if tp.min == 0 && tp.max == 0 && tp.negative == 0 {
+		return a
+	}
+
+	neg := isNegative(a)
+	newans := *a
+	newans.An = tp.clamp(a.An, neg)
+	newans.Ns = tp.clamp(a.Ns, neg)
+	newans.Ex = tp.clamp(a.Ex, neg)
+	return &newans
+}
+
+// cap of a negative answer, 0 for no limit
+func (p *ttlPolicies) negative(qname, source string) uint32 {
+	return p.get(qname, source).negative
+}
+
+func (tp *ttlPolicy) clamp(sec []dns.RR, neg bool) []dns.RR {
+	if sec == nil {
+		return nil
+	}
+
+	newsec := make([]dns.RR, len(sec))
+	for i, rr := range sec {
+		ttl := rr.Header().Ttl
+		newttl := ttl
+		if newttl < tp.min {
+			newttl = tp.min
+		}
+		if tp.max != 0 && newttl > tp.max {
+			newttl = tp.max
+		}
+		if neg && tp.negative != 0 && newttl > tp.negative {
+			newttl = tp.negative
+		}
+
+		// OPT record uses ttl field for flags
+		if newttl == ttl || rr.Header().Rrtype == dns.TypeOPT {
+			newsec[i] = rr
+			continue
+		}
+
+		newsec[i] = dns.Copy(rr)
+		newsec[i].Header().Ttl = newttl
+	}
+	return newsec
+}
+
+// NXDOMAIN or NODATA
+func isNegative(a *source.Answer) bool {
+	return a.Rcode == dns.RcodeNameError ||
+		(a.Rcode == dns.RcodeSuccess && len(a.An) == 0 && !hasType(a.Ns, dns.TypeNS))
+}
+
+func hasType(sec []dns.RR, t uint16) bool {
+	for _, rr := range sec {
+		if rr.Header().Rrtype == t {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestTTLPolicies(t *testing.T) {
+	p, err := newTTLPolicies(10, 3600, 0, "relay=::60, foo.com.=100::")
+	if err != nil {
+		t.Fatalf("cannot parse policies: %s", err)
+	}
+
+	cases := []struct {
+		qname, source, rr string
+		rcode             int
+		ttl               uint32
+	}{
+		{"bar.com.", "plain", "bar.com. 1 A 1.1.1.1", dns.RcodeSuccess, 10},
+		{"bar.com.", "plain", "bar.com. 86400 A 1.1.1.1", dns.RcodeSuccess, 3600},
+		{"bar.com.", "relay", "bar.com. 600 A 1.1.1.1", dns.RcodeSuccess, 600},
+		{"bar.com.", "relay", "com. 600 SOA a. b. 1 2 3 4 5", dns.RcodeNameError, 60},
+		{"www.foo.com.", "relay", "www.foo.com. 1 A 1.1.1.1", dns.RcodeSuccess, 100},
+	}
+
+	for _, c := range cases {
+		a := newAnswer(c.rr)
+		a.Rcode = c.rcode
+		a.Source = c.source
+		if a.Rcode != dns.RcodeSuccess {
+			a.Ns, a.An = a.An, nil
+		}
+
+		newans := p.apply(c.qname, a)
+		rr := append(newans.An, newans.Ns...)[0]
+		if rr.Header().Ttl != c.ttl {
+			t.Errorf("ttl of %s from %s: %d != %d", c.rr, c.source, rr.Header().Ttl, c.ttl)
+		}
+	}
+
+	if _, err := newTTLPolicies(0, 0, 0, "relay=1:2"); err == nil {
+		t.Errorf("invalid override should fail")
+	}
+}
+
+func TestCacheTTLClamp(t *testing.T) {
+	p, err := newTTLPolicies(60, 0, 0, "")
+	if err != nil {
+		t.Fatalf("cannot parse policies: %s", err)
+	}
+
+	c := NewCache(16, time.Hour)
+	c.ttls = p
+	key := cacheKey("foo.com.", dns.ClassINET, dns.TypeA)
+	c.Put(key, newAnswer("foo.com. 100 A 1.1.1.1"))
+
+	// counted down below the min
+	e := c.shard(key).items[key].Value.(*cacheEntry)
+	e.ts = e.ts.Add(-50 * time.Second)
+
+	a, ok := c.Get(key)
+	if !ok || a.An[0].Header().Ttl != 60 {
+		t.Errorf("ttl not clamped on get: %v", a)
+	}
+}
@@ -0,0 +1,302 @@
+// views, to serve different namespaces to different clients
+package main
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"go.papla.net/goutil/log"
+
+	"go.papla.net/yuanxiao/source"
+)
+
+// a view has its own source chain and cache.
+type view struct {
+	name     string
+	matchers []viewMatcher
+	sources  []source.Source
+	names    []string
+	ttls     *ttlPolicies
+	cache    *Cache
+	snapshot string
+	// follow CNAME through all the sources
+	chase bool
+}
+
+// properties of a query to select view
+type viewRequest struct {
+	ip    net.IP
+	ecs   *net.IPNet
+	local net.Addr
+	// verified tsig key, empty if not signed
+	tsig string
+	// select view by name, for explain
+	name string
+}
+
+type viewMatcher interface {
+	match(r *viewRequest) bool
+}
+
+type anyMatcher struct{}
+
+func (anyMatcher) match(r *viewRequest) bool {
+	return true
+}
+
+// match client address
+type cidrMatcher struct {
+	cidrList
+}
+
+func (m cidrMatcher) match(r *viewRequest) bool {
+	return m.contains(r.ip)
+}
+
+// match subnet in eDNS
+type ecsMatcher struct {
+	cidrList
+}
+
+func (m ecsMatcher) match(r *viewRequest) bool {
+	return r.ecs != nil && m.contains(r.ecs.IP)
+}
+
+// match address of listener
+type listenMatcher struct {
+	ip   net.IP
+	port int
+}
+
+func (m listenMatcher) match(r *viewRequest) bool {
+	if r.local == nil {
+		return false
+	}
+
+	ip := addrIP(r.local)
+	if ip == nil || !ip.Equal(m.ip) {
+		return false
+	}
+
+	_, port, err := net.SplitHostPort(r.local.String())
+	return err == nil && port == strconv.Itoa(m.port)
+}
+
+type tsigMatcher string
+
+func (m tsigMatcher) match(r *viewRequest) bool {
+	return r.tsig != "" && strings.EqualFold(r.tsig, string(m))
+}
+
+// parse matchers in format of type:value split by space, type is one
+// of cidr, ecs, listen, tsig, or a single any.
+func parseMatchers(s string) ([]viewMatcher, error) {
+	var ms []viewMatcher
+	for _, v := range strings.Fields(s) {
+		if v == "any" {
+			ms = append(ms, anyMatcher{})
+			continue
+		}
+
+		i := strings.Index(v, ":")
+		if i == -1 {
+			return nil, makeErr("invalid view matcher: %s", v)
+		}
+
+		t, arg := v[:i], v[i+1:]
+		switch t {
+		case "cidr", "ecs":
+			l, err := parseCIDRList(arg)
+			if err != nil {
+				return nil, err
+			}
+			if t == "cidr" {
+				ms = append(ms, cidrMatcher{l})
+			} else {
+				ms = append(ms, ecsMatcher{l})
+			}
+		case "listen":
+			host, port, err := net.SplitHostPort(arg)
+			if err != nil {
+				return nil, err
+			}
+			m := listenMatcher{ip: net.ParseIP(host)}
+			if m.ip == nil {
+				return nil, makeErr("invalid listen address: %s", arg)
+			}
+			if m.port, err = strconv.Atoi(port); err != nil {
+				return nil, makeErr("invalid listen address: %s", arg)
+			}
+			ms = append(ms, m)
+		case "tsig":
+			ms = append(ms, tsigMatcher(dns.Fqdn(arg)))
+		default:
+			return nil, makeErr("invalid view matcher: %s", v)
+		}
+	}
+	return ms, nil
+}
+
+// a view is selected if any of its matchers matches.
+func (v *view) match(r *viewRequest) bool {
+	for _, m := range v.matchers {
+		if m.match(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// flush cached answers of names changed in sources, as well as names
+// below them which may be delegated or matched by a wildcard.
+func (v *view) watch() {
+	for i, s := range v.sources {
+		n, ok := s.(source.Notifier)
+		if !ok {
+			continue
+		}
+
+		src := v.names[i]
+		n.Notify(func(name string) {
+			name = strings.TrimPrefix(name, "*.")
+			count := v.cache.FlushSuffix(name)
+			log.Debugf("view %s: %s changed in source %s, %d entries flushed", v.name, name, src, count)
+		})
+	}
+}
+
+// makes a view from options, they are in the same format as the
+// server config, without the leading "server.".
+func newView(name string, o map[string]string, ttls *ttlPolicies) (*view, error) {
+	var err error
+	v := &view{
+		name:     name,
+		ttls:     ttls,
+		snapshot: o["cache.snapshot"],
+	}
+
+	if v.matchers, err = parseMatchers(o["match"]); err != nil {
+		return nil, err
+	}
+	if len(v.matchers) == 0 {
+		return nil, makeErr("view %s option value error: match", name)
+	}
+
+	size, err := strconv.Atoi(o["cache.size"])
+	if err != nil {
+		return nil, makeErr("view %s option value error: cache.size", name)
+	}
+	timeout, err := time.ParseDuration(o["cache.timeout"])
+	if err != nil {
+		return nil, makeErr("view %s option value error: cache.timeout", name)
+	}
+
+	if v.chase, err = strconv.ParseBool(o["cname.chase"]); err != nil {
+		return nil, makeErr("view %s option value error: cname.chase", name)
+	}
+
+	// loaded after all the options are checked, so nothing is left
+	// open on errors
+	if v.sources, v.names, err = loadSources(o["source.enable"], o); err != nil {
+		return nil, err
+	}
+
+	v.cache = NewCache(size, timeout)
+	v.cache.ttls = ttls
+	if v.snapshot != "" {
+		if err = v.cache.Load(v.snapshot); err != nil {
+			log.Warnf("cannot load cache snapshot of view %s: %s", name, err)
+		}
+	}
+	v.watch()
+
+	return v, nil
+}
+
+// load views from a file of sections, each section is a view:
+//
+//	[internal]
+//	match = cidr:10.0.0.0/8 ecs:10.0.0.0/8 listen:10.0.0.1:53 tsig:key.
+//	source.enable = plain, relay
+//	source.plain.path = /etc/yuanxiao/internal
+//	cache.size = 1024
+//
+// Options not in a section inherit from the server config.
+func loadViews(path string, defaults map[string]string, ttls *ttlPolicies) (_ []*view, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var (
+		views []*view
+		name  string
+		opts  map[string]string
+	)
+
+	// close sources of the views loaded before an error
+	defer func() {
+		if err != nil {
+			closeSources(views)
+		}
+	}()
+
+	add := func() error {
+		if name == "" {
+			return nil
+		}
+		v, err := newView(name, opts, ttls)
+		if err != nil {
+			return err
+		}
+		views = append(views, v)
+		log.Infof("view %s loaded", name)
+		return nil
+	}
+
+	s := bufio.NewScanner(f)
+	lineno := 0
+	for s.Scan() {
+		lineno++
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			if err := add(); err != nil {
+				return nil, err
+			}
+
+			name = strings.TrimSpace(line[1 : len(line)-1])
+			if name == "" || name == defaultView {
+				return nil, makeErr("%s:%d: invalid view name: %s", path, lineno, name)
+			}
+			opts = make(map[string]string)
+			for k, v := range defaults {
+				opts[k] = v
+			}
+			continue
+		}
+
+		i := strings.Index(line, "=")
+		if i == -1 || name == "" {
+			return nil, makeErr("%s:%d: syntax error", path, lineno)
+		}
+		opts[strings.TrimSpace(line[:i])] = strings.TrimSpace(line[i+1:])
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := add(); err != nil {
+		return nil, err
+	}
+	return views, nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"go.papla.net/yuanxiao/source"
+)
+
+const testViews = `
+# internal clients
+[internal]
+match = cidr:10.0.0.0/8 ecs:172.16.0.0/12 tsig:internal
+source.enable = relay
+source.relay.upstream = 10.0.0.1
+cache.size = 16
+
+[lo]
+match = listen:127.0.0.1:5353
+source.enable = relay
+`
+
+func TestViews(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "views")
+	if err := os.WriteFile(path, []byte(testViews), 0644); err != nil {
+		t.Fatalf("cannot write views: %s", err)
+	}
+
+	defaults := map[string]string{
+		"source.relay.upstream": "8.8.8.8",
+		"source.relay.timeout":  "2s",
+		"cache.size":            "1024",
+		"cache.timeout":         "1m",
+		"cname.chase":           "false",
+	}
+	views, err := loadViews(path, defaults, &ttlPolicies{})
+	if err != nil {
+		t.Fatalf("cannot load views: %s", err)
+	}
+
+	ctx := &context{views: views, def: &view{name: defaultView}}
+	_, ecs, _ := net.ParseCIDR("172.16.1.0/24")
+	local := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5353}
+	cases := []struct {
+		r    *viewRequest
+		name string
+	}{
+		{&viewRequest{ip: net.ParseIP("10.1.1.1")}, "internal"},
+		{&viewRequest{ip: net.ParseIP("192.168.1.1"), ecs: ecs}, "internal"},
+		{&viewRequest{ip: net.ParseIP("192.168.1.1"), tsig: "internal."}, "internal"},
+		{&viewRequest{ip: net.ParseIP("192.168.1.1"), local: local}, "lo"},
+		{&viewRequest{ip: net.ParseIP("192.168.1.1")}, defaultView},
+	}
+
+	for _, c := range cases {
+		if v := ctx.view(c.r); v.name != c.name {
+			t.Errorf("view of %+v: %s != %s", c.r, v.name, c.name)
+		}
+	}
+}
+
+// a source notifying changes
+type notifier struct {
+	source.Source
+	f func(name string)
+}
+
+func (n *notifier) Notify(f func(name string)) {
+	n.f = f
+}
+
+func TestViewWatch(t *testing.T) {
+	n := &notifier{}
+	v := &view{
+		name:    "test",
+		sources: []source.Source{n},
+		names:   []string{"notifier"},
+		cache:   NewCache(16, time.Minute),
+	}
+	v.watch()
+
+	for _, name := range []string{"foo.com.", "www.foo.com.", "a.b.foo.com.", "bar.com."} {
+		v.cache.Put(cacheKey(name, dns.ClassINET, dns.TypeA), newAnswer(name+" 60 A 1.1.1.1"))
+	}
+
+	n.f("b.foo.com.")
+	if c := len(v.cache.Records()); c != 3 {
+		t.Errorf("names below not flushed: %d entries left", c)
+	}
+
+	n.f("*.foo.com.")
+	if c := len(v.cache.Records()); c != 1 {
+		t.Errorf("names of wildcard not flushed: %d entries left", c)
+	}
+}